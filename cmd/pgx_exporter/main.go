@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	pgxx "github.com/oscarmherrera/pgx_exporter/internal/pgxexporter"
 	"github.com/prometheus/client_golang/prometheus"
@@ -8,7 +9,9 @@ import (
 	"github.com/prometheus/common/log"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"net/http"
+	"os"
 	"runtime"
+	"strings"
 )
 
 // Version is set during build to the git describe version
@@ -17,16 +20,29 @@ import (
 var Version = "1.0.0"
 
 var (
-	buildURI               = kingpin.Flag("build-uri", "the exporter will build the uri based on DATA_SOURCE_PASS and DATA_SOURCE_USER and the HOSTNAME environment variable").Default("true").Envar("PGXEXPORTER_BUILD_URI").Bool()
+	buildURI               = kingpin.Flag("build-uri", "Sidecar mode: connect the data sources of the environment to the host given by --build-uri.host instead of theirs, keeping every other connection parameter.").Default("false").Envar("PGXEXPORTER_BUILD_URI").Bool()
+	buildURIHost           = kingpin.Flag("build-uri.host", "Host, or Unix domain socket directory, the data sources connect to in sidecar mode. The HOSTNAME environment variable if empty.").Default("").Envar("PGXEXPORTER_BUILD_URI_HOST").String()
 	listenAddress          = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9187").Envar("PGXEXPORTER_WEB_LISTEN_ADDRESS").String()
 	metricPath             = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").Envar("PGXEXPORTER_WEB_TELEMETRY_PATH").String()
 	disableDefaultMetrics  = kingpin.Flag("disable-default-metrics", "Do not include default metrics.").Default("false").Envar("PGXEXPORTER_DISABLE_DEFAULT_METRICS").Bool()
 	disableSettingsMetrics = kingpin.Flag("disable-settings-metrics", "Do not include pg_settings metrics.").Default("false").Envar("PGXEXPORTER_DISABLE_SETTINGS_METRICS").Bool()
+	settingsInfoAllowlist  = kingpin.Flag("settings-info-allowlist", "A list of string and enum settings separated by comma(,) to export as pg_settings_info.").Default("").Envar("PGXEXPORTER_SETTINGS_INFO_ALLOWLIST").String()
+	settingsSourceLabels   = kingpin.Flag("settings-source-labels", "Label pg_settings_pending_restart with the source and source file of each setting.").Default("false").Envar("PGXEXPORTER_SETTINGS_SOURCE_LABELS").Bool()
+	settingsInclude        = kingpin.Flag("settings-include", "A list of patterns separated by comma(,) of the settings to export, all if empty. Patterns are globs, or regular expressions if enclosed in slashes.").Default("").Envar("PGXEXPORTER_SETTINGS_INCLUDE").String()
+	settingsExclude        = kingpin.Flag("settings-exclude", "A list of patterns separated by comma(,) of the settings not to export.").Default("").Envar("PGXEXPORTER_SETTINGS_EXCLUDE").String()
+	configFile             = kingpin.Flag("config.file", "Path to the configuration file.").Default("").Envar("PGXEXPORTER_CONFIG_FILE").String()
 	autoDiscoverDatabases  = kingpin.Flag("auto-discover-databases", "Whether to discover the databases on a server dynamically.").Default("false").Envar("PGXEXPORTER_AUTO_DISCOVER_DATABASES").Bool()
 	queriesPath            = kingpin.Flag("extend.query-path", "Path to custom queries to run.").Default("").Envar("PGXEXPORTER_EXTEND_QUERY_PATH").String()
 	onlyDumpMaps           = kingpin.Flag("dumpmaps", "Do not run, simply dump the maps.").Bool()
 	constantLabelsList     = kingpin.Flag("constantLabels", "A list of label=value separated by comma(,).").Default("").Envar("PGXEXPORTER_CONSTANT_LABELS").String()
 	excludeDatabases       = kingpin.Flag("exclude-databases", "A list of databases to remove when autoDiscoverDatabases is enabled").Default("").Envar("PGXEXPORTER_EXCLUDE_DATABASES").String()
+	relationSizeThreshold  = kingpin.Flag("relation-size-threshold", "Minimum size in bytes of the tables and indexes reported by the size, bloat and unused index metrics.").Default("0").Envar("PGXEXPORTER_RELATION_SIZE_THRESHOLD").Int64()
+	relationTopN           = kingpin.Flag("relation-top-n", "Maximum number of tables and indexes per database reported by the size, bloat and unused index metrics, 0 for no limit.").Default("100").Envar("PGXEXPORTER_RELATION_TOP_N").Int()
+	collectBufferCache     = kingpin.Flag("collect-buffercache", "Report shared buffer usage per database and relation from the pg_buffercache extension.").Default("false").Envar("PGXEXPORTER_COLLECT_BUFFERCACHE").Bool()
+	bufferCacheInterval    = kingpin.Flag("buffercache-interval", "How long pg_buffercache metrics are cached between scrapes.").Default("5m").Envar("PGXEXPORTER_BUFFERCACHE_INTERVAL").Duration()
+	bufferCacheTopN        = kingpin.Flag("buffercache-relation-top-n", "Maximum number of relations per database reported by the pg_buffercache relation metrics, 0 for no limit.").Default("100").Envar("PGXEXPORTER_BUFFERCACHE_RELATION_TOP_N").Int()
+	waitForDatabase        = kingpin.Flag("wait-for-database", "Wait up to 5 minutes for the first data source to accept connections before serving, rather than starting at once and reporting readiness on /ready.").Default("false").Envar("PGXEXPORTER_WAIT_FOR_DATABASE").Bool()
+	idleInTxThreshold      = kingpin.Flag("idle-in-transaction-threshold", "Backends idle in transaction for longer than this are counted by pg_stat_activity_detail_idle_in_transaction_over_threshold.").Default("1m").Envar("PGXEXPORTER_IDLE_IN_TRANSACTION_THRESHOLD").Duration()
 )
 
 func main() {
@@ -43,6 +59,7 @@ func main() {
 	<body>
 	<h1>PGX exporter</h1>
 	<p><a href='` + *metricPath + `'>Metrics</a></p>
+	<p><a href='/ready'>Readiness</a></p>
 	</body>
 	</html>
 	`)
@@ -53,24 +70,67 @@ func main() {
 		return
 	}
 
-	dsn := pgxx.GetDataSources(*buildURI)
-	if len(dsn) == 0 {
-		log.Fatal("couldn't find environment variables describing the datasource to use")
+	config := &pgxx.Config{}
+	if *configFile != "" {
+		var err error
+		if config, err = pgxx.LoadConfig(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	config.Settings.Include = append(config.Settings.Include, splitList(*settingsInclude)...)
+	config.Settings.Exclude = append(config.Settings.Exclude, splitList(*settingsExclude)...)
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	var sidecarHost string
+	if *buildURI {
+		if sidecarHost = *buildURIHost; sidecarHost == "" {
+			sidecarHost = os.Getenv("HOSTNAME")
+		}
+		if sidecarHost == "" {
+			log.Fatal("--build-uri needs --build-uri.host or the HOSTNAME environment variable")
+		}
 	}
-	//Lets pause and wait for 1 minute for the database to come up
-	err := pgxx.WaitForDatabaseReadiness(dsn[0])
-	if err != nil {
-		log.Fatal("could not connect to a database")
+
+	// The exporter adds the targets of the configuration file to these.
+	dsn := pgxx.GetDataSources(sidecarHost)
+	if len(dsn) == 0 && len(config.Targets) == 0 {
+		log.Fatal("couldn't find environment variables or targets describing the datasource to use")
+	}
+	if *waitForDatabase {
+		var firstDSN string
+		if len(dsn) > 0 {
+			firstDSN = dsn[0]
+		} else {
+			firstDSN = config.Targets[0].ConnString()
+		}
+		//Lets pause and wait for the database to come up
+		err := pgxx.WaitForDatabaseReadiness(firstDSN)
+		if err != nil {
+			log.Fatal("could not connect to a database")
+		}
 	}
 
+	userFile, passFile := pgxx.GetCredentialFiles()
 	exporter := pgxx.NewExporter(dsn,
 		pgxx.DisableDefaultMetrics(*disableDefaultMetrics),
 		pgxx.DisableSettingsMetrics(*disableSettingsMetrics),
+		pgxx.SettingsInfoAllowlist(*settingsInfoAllowlist),
+		pgxx.SettingsSourceLabels(*settingsSourceLabels),
+		pgxx.WithConfig(config),
+		pgxx.CredentialFiles(userFile, passFile),
 		pgxx.AutoDiscoverDatabases(*autoDiscoverDatabases),
 		pgxx.WithUserQueriesPath(*queriesPath),
 		pgxx.WithConstantLabels(*constantLabelsList),
 		pgxx.ExcludeDatabases(*excludeDatabases),
 		pgxx.BuildURI(*buildURI),
+		pgxx.RelationSizeThreshold(*relationSizeThreshold),
+		pgxx.RelationTopN(*relationTopN),
+		pgxx.IdleInTransactionThreshold(*idleInTxThreshold),
+		pgxx.CollectBufferCache(*collectBufferCache),
+		pgxx.BufferCacheInterval(*bufferCacheInterval),
+		pgxx.BufferCacheRelationTopN(*bufferCacheTopN),
 	)
 	defer func() {
 		exporter.CloseAllServers()
@@ -79,6 +139,7 @@ func main() {
 	prometheus.MustRegister(exporter)
 
 	http.Handle(*metricPath, promhttp.Handler())
+	http.HandleFunc("/ready", readyHandler(exporter))
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "Content-Type:text/plain; charset=UTF-8") // nolint: errcheck
 		_, err := w.Write(landingPage)
@@ -91,3 +152,34 @@ func main() {
 	log.Infof("Starting Server: %s", *listenAddress)
 	log.Fatal(http.ListenAndServe(*listenAddress, nil))
 }
+
+// Serve the readiness of every target as JSON, with status 503 unless all of
+// them are ready.
+func readyHandler(exporter *pgxx.Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		readiness := exporter.CheckReadiness()
+		status := http.StatusOK
+		for _, target := range readiness {
+			if !target.Ready {
+				status = http.StatusServiceUnavailable
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(readiness); err != nil {
+			log.Errorf("Unable to write readiness: %s", err)
+		}
+	}
+}
+
+// Split a comma separated flag value, ignoring empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
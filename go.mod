@@ -4,6 +4,7 @@ go 1.14
 
 require (
 	github.com/blang/semver v3.5.1+incompatible
+	github.com/jackc/pgconn v1.5.0
 	github.com/jackc/pgproto3/v2 v2.0.1
 	github.com/jackc/pgx/v4 v4.6.0
 	github.com/lib/pq v1.2.0
@@ -0,0 +1,159 @@
+package pgxexporter
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Defaults of BackoffConfig.
+const (
+	defaultFailureThreshold = 3
+	defaultInitialInterval  = 10 * time.Second
+	defaultMaxInterval      = 5 * time.Minute
+)
+
+// States of a circuit breaker, as exported.
+const (
+	breakerClosed   = 0
+	breakerOpen     = 1
+	breakerHalfOpen = 2
+)
+
+// Why a DSN which was never connected to is not ready.
+var errNotConnected = errors.New("Not connected yet, waiting for the first scrape")
+
+// backoff is how connecting to an unreachable DSN is retried.
+type backoff struct {
+	failureThreshold int
+	initialInterval  time.Duration
+	maxInterval      time.Duration
+}
+
+func defaultBackoff() backoff {
+	return backoff{
+		failureThreshold: defaultFailureThreshold,
+		initialInterval:  defaultInitialInterval,
+		maxInterval:      defaultMaxInterval,
+	}
+}
+
+// Return the backoff with the options set in c replaced.
+func (b backoff) merge(c BackoffConfig) backoff {
+	if c.FailureThreshold != nil {
+		b.failureThreshold = *c.FailureThreshold
+	}
+	if c.InitialInterval != nil {
+		b.initialInterval = *c.InitialInterval
+	}
+	if c.MaxInterval != nil {
+		b.maxInterval = *c.MaxInterval
+	}
+	return b
+}
+
+// Return how long the breaker stays open after it opened for the nth time in
+// a row, starting at 0: the interval doubles each time up to its maximum, and
+// a random half of it is subtracted so that retries do not synchronise.
+func (b backoff) interval(n int, rnd *rand.Rand) time.Duration {
+	d := b.initialInterval
+	for i := 0; i < n && d < b.maxInterval; i++ {
+		d *= 2
+	}
+	if d > b.maxInterval {
+		d = b.maxInterval
+	}
+	return d/2 + time.Duration(rnd.Int63n(int64(d/2)+1))
+}
+
+// breaker is the circuit breaker of a DSN. It opens after a number of
+// consecutive connection failures, failing fast without connecting until its
+// backoff interval has passed. The next attempt then closes it again if it
+// succeeds, or reopens it for a longer interval.
+type breaker struct {
+	labels    prometheus.Labels
+	failures  int
+	nextRetry time.Time
+	// Whether the DSN was ever connected to, and why the last attempt
+	// failed, if it did
+	connected bool
+	lastErr   error
+}
+
+// Report the state of the breaker at now.
+func (b *breaker) state(now time.Time) int {
+	switch {
+	case b.nextRetry.IsZero():
+		return breakerClosed
+	case now.Before(b.nextRetry):
+		return breakerOpen
+	default:
+		return breakerHalfOpen
+	}
+}
+
+// Return an error if the breaker is open at now.
+func (b *breaker) allow(now time.Time) error {
+	if b.state(now) == breakerOpen {
+		return fmt.Errorf("Circuit breaker open after %d connection failures, retrying in %s", b.failures, b.nextRetry.Sub(now).Round(time.Second))
+	}
+	return nil
+}
+
+// Record a failed connection at now, opening the breaker once there have
+// been enough in a row.
+func (b *breaker) failure(now time.Time, err error, backoff backoff, rnd *rand.Rand) {
+	b.failures++
+	b.lastErr = err
+	if b.failures >= backoff.failureThreshold {
+		b.nextRetry = now.Add(backoff.interval(b.failures-backoff.failureThreshold, rnd))
+	}
+}
+
+// Record a successful connection, closing the breaker.
+func (b *breaker) success() {
+	b.failures = 0
+	b.nextRetry = time.Time{}
+	b.connected = true
+	b.lastErr = nil
+}
+
+// Return why the DSN is not ready at now, from its last connection attempt,
+// or nil if it is.
+func (b *breaker) ready(now time.Time) error {
+	if err := b.allow(now); err != nil {
+		return err
+	}
+	if b.lastErr != nil {
+		return b.lastErr
+	}
+	if !b.connected {
+		return errNotConnected
+	}
+	return nil
+}
+
+// Send the state of the breaker at now, and when it is retried if not closed.
+func (b *breaker) collect(ch chan<- prometheus.Metric, now time.Time) {
+	state := b.state(now)
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "circuit_breaker_state"),
+			"State of the circuit breaker of the connections to the database: 0 closed, 1 open and failing scrapes fast, 2 half-open and retrying on the next scrape.",
+			nil, b.labels),
+		prometheus.GaugeValue, float64(state))
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "connection_failures"),
+			"Number of consecutive failures to connect to the database.",
+			nil, b.labels),
+		prometheus.GaugeValue, float64(b.failures))
+	if state != breakerClosed {
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "circuit_breaker_next_retry_timestamp_seconds"),
+				"Time the open circuit breaker lets the next connection attempt through, in seconds since the epoch.",
+				nil, b.labels),
+			prometheus.GaugeValue, float64(b.nextRetry.UnixNano())/1e9)
+	}
+}
@@ -0,0 +1,155 @@
+package pgxexporter
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/common/log"
+)
+
+// capabilities describes what a server is able to answer beyond its version,
+// so namespaces can be gated on more than semver ranges. They are probed
+// whenever the metric map of a server is recalculated.
+type capabilities struct {
+	extensions map[string]string // Installed extensions and their versions
+	relations  map[string]bool   // Catalog relations, of those namespaces require
+}
+
+func (c *capabilities) hasRelation(name string) bool {
+	return c.relations[name]
+}
+
+// Report whether the extension is installed in a version satisfying the
+// requirement. Extension versions which are not semantic versions only satisfy
+// requirements without a version range.
+func (c *capabilities) hasExtension(r *extensionRequirement) bool {
+	version, ok := c.extensions[r.name]
+	if !ok {
+		return false
+	}
+	if r.versionRange == nil {
+		return true
+	}
+	v, err := semver.ParseTolerant(version)
+	if err != nil {
+		log.Debugf("Unable to parse version %q of extension %s: %v", version, r.name, err)
+		return false
+	}
+	return r.versionRange(v)
+}
+
+// extensionRequirement is an extension a namespace requires to be installed,
+// optionally in a range of versions.
+type extensionRequirement struct {
+	name         string
+	versionRange semver.Range // Any version if nil
+	text         string       // As written by the user, for logging
+}
+
+func (r *extensionRequirement) String() string {
+	return r.text
+}
+
+var extensionRequirementRegex = regexp.MustCompile(`^([A-Za-z0-9_-]+)\s*([<>=!].*)?$`)
+
+// Versions in a range, which extensions usually give as major.minor only.
+var rangeVersionRegex = regexp.MustCompile(`\d+(\.\d+)*`)
+
+// Parses an extension requirement of the form "name" or "name>=version", where
+// the version part is any semver range such as ">=1.8 <2.0". Versions are
+// completed to major.minor.patch as semver requires.
+func parseExtensionRequirement(s string) (*extensionRequirement, error) {
+	s = strings.TrimSpace(s)
+	submatches := extensionRequirementRegex.FindStringSubmatch(s)
+	if submatches == nil {
+		return nil, fmt.Errorf("Invalid extension requirement %q", s)
+	}
+
+	r := &extensionRequirement{name: submatches[1], text: s}
+	if submatches[2] != "" {
+		versions := rangeVersionRegex.ReplaceAllStringFunc(submatches[2], func(v string) string {
+			for strings.Count(v, ".") < 2 {
+				v += ".0"
+			}
+			return v
+		})
+		versionRange, err := semver.ParseRange(strings.TrimSpace(versions))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid version range in extension requirement %q: %v", s, err)
+		}
+		r.versionRange = versionRange
+	}
+	return r, nil
+}
+
+func mustParseExtensionRequirement(s string) *extensionRequirement {
+	r, err := parseExtensionRequirement(s)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Probe the server on conn for installed extensions and the relations
+// required by namespaceRequirements.
+func probeCapabilities(ctx context.Context, conn *pgx.Conn) (*capabilities, error) {
+	c := &capabilities{
+		extensions: make(map[string]string),
+		relations:  make(map[string]bool),
+	}
+
+	rows, err := conn.Query(ctx, "SELECT extname, extversion FROM pg_extension")
+	if err != nil {
+		return nil, fmt.Errorf("Error querying extensions: %v", err)
+	}
+	for rows.Next() {
+		var name, version string
+		if err := rows.Scan(&name, &version); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("Error scanning extensions: %v", err)
+		}
+		c.extensions[name] = version
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error querying extensions: %v", err)
+	}
+
+	var required []string
+	for _, requirement := range namespaceRequirements {
+		required = append(required, requirement.relations...)
+	}
+
+	// Only the catalogs are looked at, which EDB Postgres Advanced Server
+	// extends with the sys schema, so that the result does not depend on the
+	// search path or on user relations of the same name.
+	rows, err = conn.Query(ctx, `
+		SELECT c.relname::text
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relname::text = ANY($1::text[])
+			AND n.nspname IN ('pg_catalog', 'sys')
+		`, required)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying relations: %v", err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("Error scanning relations: %v", err)
+		}
+		c.relations[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error querying relations: %v", err)
+	}
+
+	log.Debugf("Probed capabilities: %d extensions, relations %v", len(c.extensions), c.relations)
+	return c, nil
+}
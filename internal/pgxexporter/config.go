@@ -1,6 +1,9 @@
 package pgxexporter
 
-import "strings"
+import (
+	"strings"
+	"time"
+)
 
 // ExporterOpt configures Exporter.
 type ExporterOpt func(*Exporter)
@@ -53,3 +56,89 @@ func BuildURI(f bool) ExporterOpt {
 		e.buildURI = f
 	}
 }
+
+// RelationSizeThreshold configures the minimum size in bytes of the relations
+// reported by the per relation namespaces.
+func RelationSizeThreshold(b int64) ExporterOpt {
+	return func(e *Exporter) {
+		e.relationSizeThreshold = b
+	}
+}
+
+// RelationTopN limits the per relation namespaces to the n largest relations
+// of each database, 0 means no limit.
+func RelationTopN(n int) ExporterOpt {
+	return func(e *Exporter) {
+		e.relationTopN = n
+	}
+}
+
+// BufferCacheRelationTopN limits pg_buffercache_relation to the n relations
+// holding the most buffers, 0 means no limit.
+func BufferCacheRelationTopN(n int) ExporterOpt {
+	return func(e *Exporter) {
+		e.bufferCacheRelationTopN = n
+	}
+}
+
+// IdleInTransactionThreshold configures how long a backend has to be idle in
+// transaction before it is counted by pg_stat_activity_detail.
+func IdleInTransactionThreshold(d time.Duration) ExporterOpt {
+	return func(e *Exporter) {
+		e.idleInTransactionThreshold = d
+	}
+}
+
+// CollectBufferCache enables the pg_buffercache namespaces, which are only
+// queried where the extension is installed.
+func CollectBufferCache(b bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.collectBufferCache = b
+	}
+}
+
+// BufferCacheInterval configures how long the pg_buffercache namespaces are
+// cached between scrapes.
+func BufferCacheInterval(d time.Duration) ExporterOpt {
+	return func(e *Exporter) {
+		e.bufferCacheInterval = d
+	}
+}
+
+// SettingsInfoAllowlist configures the comma separated string and enum settings
+// exported by pg_settings_info. None are exported if empty.
+func SettingsInfoAllowlist(s string) ExporterOpt {
+	return func(e *Exporter) {
+		e.settingsInfoAllowlist = nil
+		for _, name := range strings.Split(s, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				e.settingsInfoAllowlist = append(e.settingsInfoAllowlist, name)
+			}
+		}
+	}
+}
+
+// SettingsSourceLabels labels pg_settings_pending_restart with the source and
+// source file of each setting.
+func SettingsSourceLabels(b bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.settingsSourceLabels = b
+	}
+}
+
+// WithConfig configures the options of the configuration file.
+func WithConfig(c *Config) ExporterOpt {
+	return func(e *Exporter) {
+		e.config = *c
+	}
+}
+
+// CredentialFiles configures the files the credentials of the data sources of
+// the environment are read from, see GetCredentialFiles. They are read again
+// when they change.
+func CredentialFiles(userFile, passFile string) ExporterOpt {
+	return func(e *Exporter) {
+		e.credentialUserFile = userFile
+		e.credentialPassFile = passFile
+	}
+}
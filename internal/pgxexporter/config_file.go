@@ -0,0 +1,419 @@
+package pgxexporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the contents of the exporter's configuration file, for options
+// which are too unwieldy for flags.
+type Config struct {
+	Settings SettingsConfig `yaml:"settings"`
+	// Pool settings of every target
+	Pool PoolConfig `yaml:"pool"`
+	// Session settings of the connections to every target
+	Session SessionConfig `yaml:"session"`
+	// TLS settings of the connections to every target
+	TLS *TLSConfig `yaml:"tls"`
+	// Provider of the credentials of every target
+	Secrets *SecretsConfig `yaml:"secrets"`
+	// How connecting to unreachable targets is retried
+	Backoff BackoffConfig `yaml:"backoff"`
+	// Targets scraped in addition to those of the environment
+	Targets []TargetConfig `yaml:"targets"`
+}
+
+// PoolConfig configures the connection pool of a target. Unset options keep
+// their defaults.
+type PoolConfig struct {
+	MinConns          *int32         `yaml:"min_conns"`
+	MaxConns          *int32         `yaml:"max_conns"`
+	MaxConnLifetime   *time.Duration `yaml:"max_conn_lifetime"`
+	MaxConnIdleTime   *time.Duration `yaml:"max_conn_idle_time"`
+	HealthCheckPeriod *time.Duration `yaml:"health_check_period"`
+}
+
+// Return the pool settings with those set in override replaced.
+func (p PoolConfig) merge(override PoolConfig) PoolConfig {
+	if override.MinConns != nil {
+		p.MinConns = override.MinConns
+	}
+	if override.MaxConns != nil {
+		p.MaxConns = override.MaxConns
+	}
+	if override.MaxConnLifetime != nil {
+		p.MaxConnLifetime = override.MaxConnLifetime
+	}
+	if override.MaxConnIdleTime != nil {
+		p.MaxConnIdleTime = override.MaxConnIdleTime
+	}
+	if override.HealthCheckPeriod != nil {
+		p.HealthCheckPeriod = override.HealthCheckPeriod
+	}
+	return p
+}
+
+// Validate the pool settings as they take effect, with the defaults of
+// NewServer for those unset.
+func (p PoolConfig) validate() error {
+	var minConns, maxConns int32 = defaultMinConns, defaultMaxConns
+	if p.MinConns != nil {
+		minConns = *p.MinConns
+	}
+	if p.MaxConns != nil {
+		maxConns = *p.MaxConns
+	}
+	if maxConns < 1 {
+		return fmt.Errorf("max_conns must be at least 1")
+	}
+	if minConns < 0 {
+		return fmt.Errorf("min_conns must not be negative")
+	}
+	if minConns > maxConns {
+		return fmt.Errorf("min_conns must not exceed max_conns")
+	}
+	return nil
+}
+
+// BackoffConfig configures the circuit breakers of the targets. Unset options
+// keep their defaults.
+type BackoffConfig struct {
+	// Consecutive connection failures after which the breaker opens
+	FailureThreshold *int `yaml:"failure_threshold"`
+	// How long the breaker first stays open, doubling every time it reopens
+	InitialInterval *time.Duration `yaml:"initial_interval"`
+	// The longest the breaker stays open
+	MaxInterval *time.Duration `yaml:"max_interval"`
+}
+
+func (c BackoffConfig) validate() error {
+	b := defaultBackoff().merge(c)
+	if b.failureThreshold < 1 {
+		return fmt.Errorf("failure_threshold must be at least 1")
+	}
+	if b.initialInterval <= 0 || b.maxInterval <= 0 {
+		return fmt.Errorf("initial_interval and max_interval must be positive")
+	}
+	if b.initialInterval > b.maxInterval {
+		return fmt.Errorf("initial_interval must not exceed max_interval")
+	}
+	return nil
+}
+
+// SessionConfig configures the sessions of the exporter's connections, so
+// that a bad query can neither run away nor hold locks. Unset options keep
+// the defaults of defaultSessionConfig, a zero timeout disables it.
+type SessionConfig struct {
+	ApplicationName                 *string        `yaml:"application_name"`
+	StatementTimeout                *time.Duration `yaml:"statement_timeout"`
+	LockTimeout                     *time.Duration `yaml:"lock_timeout"`
+	IdleInTransactionSessionTimeout *time.Duration `yaml:"idle_in_transaction_session_timeout"`
+	ReadOnly                        *bool          `yaml:"read_only"`
+}
+
+// Return the session settings with those set in override replaced.
+func (c SessionConfig) merge(override SessionConfig) SessionConfig {
+	if override.ApplicationName != nil {
+		c.ApplicationName = override.ApplicationName
+	}
+	if override.StatementTimeout != nil {
+		c.StatementTimeout = override.StatementTimeout
+	}
+	if override.LockTimeout != nil {
+		c.LockTimeout = override.LockTimeout
+	}
+	if override.IdleInTransactionSessionTimeout != nil {
+		c.IdleInTransactionSessionTimeout = override.IdleInTransactionSessionTimeout
+	}
+	if override.ReadOnly != nil {
+		c.ReadOnly = override.ReadOnly
+	}
+	return c
+}
+
+func (c SessionConfig) validate() error {
+	for name, timeout := range map[string]*time.Duration{
+		"statement_timeout":                   c.StatementTimeout,
+		"lock_timeout":                        c.LockTimeout,
+		"idle_in_transaction_session_timeout": c.IdleInTransactionSessionTimeout,
+	} {
+		if timeout != nil && *timeout < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// TLSConfig configures TLS for the connections to a target, instead of the
+// sslmode and related parameters of its DSN. The files are read again when
+// they change.
+type TLSConfig struct {
+	// CA certificates to verify the server with, the system's if empty
+	CAFile string `yaml:"ca_file"`
+	// Client certificate and key to authenticate with, if any
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// Name to verify the server certificate for, the host of the DSN if empty
+	ServerName string `yaml:"server_name"`
+	// Do not verify the server certificate at all
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+func (c *TLSConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be given together")
+	}
+	if _, err := newTLSFiles(*c); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SecretsConfig selects the provider the credentials of a target are obtained
+// from, overriding those of its DSN. Exactly one must be set.
+type SecretsConfig struct {
+	File  *FileSecretsConfig  `yaml:"file"`
+	Exec  *ExecSecretsConfig  `yaml:"exec"`
+	Vault *VaultSecretsConfig `yaml:"vault"`
+}
+
+// FileSecretsConfig reads the user name and password from files.
+type FileSecretsConfig struct {
+	UserFile string `yaml:"user_file"`
+	PassFile string `yaml:"pass_file"`
+}
+
+// ExecSecretsConfig runs a command printing the credentials.
+type ExecSecretsConfig struct {
+	// Program and arguments, run without a shell
+	Command []string `yaml:"command"`
+	// How long the command may take, 10s if zero
+	Timeout time.Duration `yaml:"timeout"`
+	// How often to run the command again if the credentials have no expiry,
+	// only on authentication failures if zero
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+// VaultSecretsConfig obtains credentials from the database secrets engine of
+// HashiCorp Vault.
+type VaultSecretsConfig struct {
+	// Address of the Vault server, VAULT_ADDR if empty
+	Address string `yaml:"address"`
+	// File the token is read from, VAULT_TOKEN if empty
+	TokenFile string `yaml:"token_file"`
+	// Mount path of the database secrets engine, "database" if empty
+	Mount string `yaml:"mount"`
+	// Role to generate credentials for
+	Role string `yaml:"role"`
+	// CA certificates to verify Vault with, the system's if empty
+	CAFile string `yaml:"ca_file"`
+}
+
+func (c *SecretsConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	providers := 0
+	for _, set := range []bool{c.File != nil, c.Exec != nil, c.Vault != nil} {
+		if set {
+			providers++
+		}
+	}
+	if providers != 1 {
+		return fmt.Errorf("exactly one of file, exec and vault must be given")
+	}
+	switch {
+	case c.File != nil && c.File.UserFile == "" && c.File.PassFile == "":
+		return fmt.Errorf("file needs a user_file or a pass_file")
+	case c.Exec != nil && len(c.Exec.Command) == 0:
+		return fmt.Errorf("exec needs a command")
+	case c.Exec != nil && (c.Exec.Timeout < 0 || c.Exec.RefreshInterval < 0):
+		return fmt.Errorf("exec timeout and refresh_interval must not be negative")
+	case c.Vault != nil && c.Vault.Role == "":
+		return fmt.Errorf("vault needs a role")
+	case c.Vault != nil && c.Vault.Address == "" && os.Getenv("VAULT_ADDR") == "":
+		return fmt.Errorf("vault needs an address or VAULT_ADDR")
+	case c.Vault != nil && c.Vault.TokenFile == "" && os.Getenv("VAULT_TOKEN") == "":
+		return fmt.Errorf("vault needs a token_file or VAULT_TOKEN")
+	}
+	_, err := c.provider()
+	return err
+}
+
+// Create the configured secret provider.
+func (c *SecretsConfig) provider() (SecretProvider, error) {
+	switch {
+	case c.File != nil:
+		return newFileSecretProvider(c.File.UserFile, c.File.PassFile), nil
+	case c.Exec != nil:
+		return newExecSecretProvider(*c.Exec), nil
+	case c.Vault != nil:
+		return newVaultSecretProvider(*c.Vault)
+	}
+	return nil, fmt.Errorf("no secret provider configured")
+}
+
+// TargetConfig is a server to scrape and the options specific to it, which
+// also apply to the databases discovered on it.
+type TargetConfig struct {
+	DSN string `yaml:"dsn"`
+	// Service of the service file to connect to, instead of a DSN
+	Service string        `yaml:"service"`
+	Pool    PoolConfig    `yaml:"pool"`
+	Session SessionConfig `yaml:"session"`
+	// Replaces the global TLS settings if set
+	TLS *TLSConfig `yaml:"tls"`
+	// Replaces the global secret provider if set
+	Secrets *SecretsConfig `yaml:"secrets"`
+}
+
+// ConnString returns the DSN of the target, or refers to its service.
+func (t TargetConfig) ConnString() string {
+	if t.Service != "" {
+		return "service=" + t.Service
+	}
+	return t.DSN
+}
+
+// SettingsConfig selects the pg_settings which are exported.
+type SettingsConfig struct {
+	// Name patterns of the settings to export, all if empty
+	Include []string `yaml:"include"`
+	// Name patterns of the settings not to export, even if included
+	Exclude []string `yaml:"exclude"`
+}
+
+// LoadConfig reads and validates the configuration file at path.
+func LoadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading config file %q: %v", path, err)
+	}
+
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, fmt.Errorf("Error parsing config file %q: %v", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("Error in config file %q: %v", path, err)
+	}
+	return config, nil
+}
+
+// Validate checks the configuration, including options merged into it from
+// flags.
+func (c *Config) Validate() error {
+	if _, err := newNameFilter(c.Settings.Include, c.Settings.Exclude); err != nil {
+		return fmt.Errorf("Invalid settings pattern: %v", err)
+	}
+	if err := c.Pool.validate(); err != nil {
+		return fmt.Errorf("Invalid pool: %v", err)
+	}
+	if err := c.Session.validate(); err != nil {
+		return fmt.Errorf("Invalid session: %v", err)
+	}
+	if err := c.TLS.validate(); err != nil {
+		return fmt.Errorf("Invalid tls: %v", err)
+	}
+	if err := c.Secrets.validate(); err != nil {
+		return fmt.Errorf("Invalid secrets: %v", err)
+	}
+	if err := c.Backoff.validate(); err != nil {
+		return fmt.Errorf("Invalid backoff: %v", err)
+	}
+	for i, target := range c.Targets {
+		if (target.DSN == "") == (target.Service == "") {
+			return fmt.Errorf("Target %d needs either a dsn or a service", i)
+		}
+		if err := c.Pool.merge(target.Pool).validate(); err != nil {
+			return fmt.Errorf("Invalid pool of target %d: %v", i, err)
+		}
+		if err := target.Session.validate(); err != nil {
+			return fmt.Errorf("Invalid session of target %d: %v", i, err)
+		}
+		if err := target.TLS.validate(); err != nil {
+			return fmt.Errorf("Invalid tls of target %d: %v", i, err)
+		}
+		if err := target.Secrets.validate(); err != nil {
+			return fmt.Errorf("Invalid secrets of target %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// nameFilter selects names by include and exclude patterns. Patterns are globs
+// as understood by path.Match, or regular expressions if enclosed in slashes,
+// as in "/^autovacuum_/".
+type nameFilter struct {
+	include, exclude []func(string) bool
+}
+
+func newNameFilter(include, exclude []string) (*nameFilter, error) {
+	f := &nameFilter{}
+	for _, pattern := range include {
+		match, err := compileNamePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, match)
+	}
+	for _, pattern := range exclude {
+		match, err := compileNamePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, match)
+	}
+	return f, nil
+}
+
+func compileNamePattern(pattern string) (func(string) bool, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", pattern, err)
+		}
+		return re.MatchString, nil
+	}
+
+	// path.Match only reports malformed patterns when matching.
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("%q: %v", pattern, err)
+	}
+	return func(name string) bool {
+		matched, _ := path.Match(pattern, name)
+		return matched
+	}, nil
+}
+
+// Report whether the name is included and not excluded. A nil filter matches
+// every name.
+func (f *nameFilter) match(name string) bool {
+	if f == nil {
+		return true
+	}
+	for _, exclude := range f.exclude {
+		if exclude(name) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, include := range f.include {
+		if include(name) {
+			return true
+		}
+	}
+	return false
+}
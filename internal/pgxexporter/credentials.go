@@ -0,0 +1,139 @@
+package pgxexporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+// Credentials are a user name and password overriding those of a DSN. Either
+// may be empty to keep the one of the DSN.
+type Credentials struct {
+	User     string
+	Password string
+	// When the credentials stop being valid, zero if never
+	Expiry time.Time
+}
+
+// Report whether the credentials log in as the same user with the same
+// password as other.
+func (c Credentials) equal(other Credentials) bool {
+	return c.User == other.User && c.Password == other.Password
+}
+
+// SecretProvider obtains the credentials of the data sources, such as from
+// files, a command or Vault. It is shared by the servers of a target, so it
+// must be safe for concurrent use.
+type SecretProvider interface {
+	// Credentials returns the current credentials, obtaining new ones before
+	// the previous expire.
+	Credentials(ctx context.Context) (Credentials, error)
+	// Invalidate reports credentials the server rejected, so that the next
+	// call obtains them again unless they changed meanwhile.
+	Invalidate(c Credentials)
+}
+
+// Return when credentials obtained at fetched should be refreshed, a third of
+// their lifetime before they expire. Credentials without expiry are kept.
+func refreshTime(fetched, expiry time.Time) time.Time {
+	if expiry.IsZero() {
+		return time.Time{}
+	}
+	return fetched.Add(expiry.Sub(fetched) * 2 / 3)
+}
+
+// fileSecretProvider reads the user name and password from files, such as a
+// mounted Kubernetes secret. They are read again when they change or are
+// invalidated, so rotated credentials are picked up without a restart.
+type fileSecretProvider struct {
+	userFile, passFile string
+
+	mtx         sync.Mutex
+	modTimes    map[string]time.Time
+	credentials Credentials
+	invalid     bool
+}
+
+func newFileSecretProvider(userFile, passFile string) *fileSecretProvider {
+	return &fileSecretProvider{userFile: userFile, passFile: passFile}
+}
+
+// Credentials reads the files if they have been modified since they were last
+// read, or were invalidated. Credentials whose file is not configured are
+// returned empty.
+func (p *fileSecretProvider) Credentials(ctx context.Context) (Credentials, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	modTimes := make(map[string]time.Time)
+	modified := p.invalid || p.modTimes == nil
+	for _, path := range []string{p.userFile, p.passFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("Error reading credentials: %v", err)
+		}
+		modTimes[path] = info.ModTime()
+		if !info.ModTime().Equal(p.modTimes[path]) {
+			modified = true
+		}
+	}
+	if !modified {
+		return p.credentials, nil
+	}
+
+	user, err := readCredentialFile(p.userFile)
+	if err != nil {
+		return Credentials{}, err
+	}
+	pass, err := readCredentialFile(p.passFile)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	p.modTimes, p.invalid = modTimes, false
+	p.credentials = Credentials{User: user, Password: pass}
+	return p.credentials, nil
+}
+
+// Invalidate makes the next call read the files again, even if their
+// modification times did not change, as when rewritten within their
+// resolution.
+func (p *fileSecretProvider) Invalidate(c Credentials) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if c.equal(p.credentials) {
+		p.invalid = true
+	}
+}
+
+func readCredentialFile(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Error reading credentials: %v", err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// Report whether the server rejected the credentials of a connection.
+func isAuthError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	// invalid_password and invalid_authorization_specification
+	return pgErr.Code == "28P01" || pgErr.Code == "28000"
+}
@@ -0,0 +1,113 @@
+package pgxexporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Default time the credentials command may take.
+const defaultExecSecretTimeout = 10 * time.Second
+
+// execSecretProvider runs a command and reads the credentials from its
+// output. The output is either the password alone, or a JSON object with the
+// username, password and an optional RFC 3339 expiry:
+//
+//	{"username": "exporter", "password": "secret", "expiry": "2020-06-01T12:00:00Z"}
+//
+// The command is run again before the credentials expire, after the refresh
+// interval if they have no expiry, or when they are invalidated.
+type execSecretProvider struct {
+	command         []string
+	timeout         time.Duration
+	refreshInterval time.Duration
+	now             func() time.Time
+
+	mtx         sync.Mutex
+	credentials Credentials
+	valid       bool
+	refreshAt   time.Time
+}
+
+func newExecSecretProvider(c ExecSecretsConfig) *execSecretProvider {
+	p := &execSecretProvider{
+		command:         c.Command,
+		timeout:         c.Timeout,
+		refreshInterval: c.RefreshInterval,
+		now:             time.Now,
+	}
+	if p.timeout == 0 {
+		p.timeout = defaultExecSecretTimeout
+	}
+	return p
+}
+
+// Credentials returns the credentials last output by the command, running it
+// if they are due to be refreshed.
+func (p *execSecretProvider) Credentials(ctx context.Context) (Credentials, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.valid && (p.refreshAt.IsZero() || p.now().Before(p.refreshAt)) {
+		return p.credentials, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.command[0], p.command[1:]...)
+	cmd.Stderr = &stderr
+	// The output is never logged, as it holds the password.
+	out, err := cmd.Output()
+	if err != nil {
+		return Credentials{}, fmt.Errorf("Error running credentials command %q: %v: %s", p.command[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	credentials, err := parseExecSecretOutput(out)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("Error parsing output of credentials command %q: %v", p.command[0], err)
+	}
+
+	now := p.now()
+	p.credentials, p.valid = credentials, true
+	p.refreshAt = refreshTime(now, credentials.Expiry)
+	if p.refreshAt.IsZero() && p.refreshInterval > 0 {
+		p.refreshAt = now.Add(p.refreshInterval)
+	}
+	return credentials, nil
+}
+
+// Invalidate makes the next call run the command again.
+func (p *execSecretProvider) Invalidate(c Credentials) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if c.equal(p.credentials) {
+		p.valid = false
+	}
+}
+
+func parseExecSecretOutput(out []byte) (Credentials, error) {
+	out = bytes.TrimSpace(out)
+	if len(out) == 0 {
+		return Credentials{}, errors.New("no output")
+	}
+	if out[0] != '{' {
+		return Credentials{Password: string(out)}, nil
+	}
+
+	var output struct {
+		Username string    `json:"username"`
+		Password string    `json:"password"`
+		Expiry   time.Time `json:"expiry"`
+	}
+	// Errors would quote the output.
+	if err := json.Unmarshal(out, &output); err != nil {
+		return Credentials{}, errors.New("invalid JSON")
+	}
+	return Credentials{User: output.Username, Password: output.Password, Expiry: output.Expiry}, nil
+}
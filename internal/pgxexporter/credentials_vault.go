@@ -0,0 +1,237 @@
+package pgxexporter
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// Default mount path of the Vault database secrets engine.
+const defaultVaultMount = "database"
+
+// vaultSecretProvider obtains dynamic credentials from the database secrets
+// engine of HashiCorp Vault. Their lease is renewed before it expires, and
+// new credentials are obtained once it can no longer be renewed for long.
+type vaultSecretProvider struct {
+	address   string
+	mount     string
+	role      string
+	token     string
+	tokenFile string
+	client    *http.Client
+	now       func() time.Time
+
+	mtx         sync.Mutex
+	credentials Credentials
+	valid       bool
+	refreshAt   time.Time
+	lease       vaultLease
+	// Renewal or request of credentials in flight, which other callers wait
+	// for, if any
+	refreshing *vaultRefresh
+}
+
+// vaultRefresh is a renewal or request of credentials in flight.
+type vaultRefresh struct {
+	done        chan struct{}
+	credentials Credentials
+	err         error
+}
+
+// vaultLease is the lease of the credentials as returned by Vault.
+type vaultLease struct {
+	ID        string `json:"lease_id"`
+	Duration  int64  `json:"lease_duration"`
+	Renewable bool   `json:"renewable"`
+}
+
+func newVaultSecretProvider(c VaultSecretsConfig) (*vaultSecretProvider, error) {
+	p := &vaultSecretProvider{
+		address:   strings.TrimRight(c.Address, "/"),
+		mount:     strings.Trim(c.Mount, "/"),
+		role:      c.Role,
+		token:     os.Getenv("VAULT_TOKEN"),
+		tokenFile: c.TokenFile,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		now:       time.Now,
+	}
+	if p.address == "" {
+		p.address = strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+	}
+	if p.mount == "" {
+		p.mount = defaultVaultMount
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading Vault CA file: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Error reading Vault CA file %q: no certificates found", c.CAFile)
+		}
+		p.client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}
+	}
+	return p, nil
+}
+
+// Credentials returns the current credentials, renewing their lease or
+// obtaining new ones when a third of the lease is left. Only one caller talks
+// to Vault at a time, without holding the lock, and the others wait for its
+// result.
+func (p *vaultSecretProvider) Credentials(ctx context.Context) (Credentials, error) {
+	p.mtx.Lock()
+	now := p.now()
+	if p.valid && (p.refreshAt.IsZero() || now.Before(p.refreshAt)) {
+		defer p.mtx.Unlock()
+		return p.credentials, nil
+	}
+	if r := p.refreshing; r != nil {
+		p.mtx.Unlock()
+		select {
+		case <-r.done:
+			return r.credentials, r.err
+		case <-ctx.Done():
+			return Credentials{}, ctx.Err()
+		}
+	}
+
+	r := &vaultRefresh{done: make(chan struct{})}
+	p.refreshing = r
+	renewable := p.valid && p.lease.Renewable && now.Before(p.credentials.Expiry)
+	lease := p.lease
+	p.mtx.Unlock()
+
+	r.credentials, r.err = p.refresh(ctx, now, renewable, lease)
+
+	p.mtx.Lock()
+	p.refreshing = nil
+	p.mtx.Unlock()
+	close(r.done)
+	return r.credentials, r.err
+}
+
+// Renew the lease of the credentials if renewable, or obtain new ones, as of
+// now.
+func (p *vaultSecretProvider) refresh(ctx context.Context, now time.Time, renewable bool, lease vaultLease) (Credentials, error) {
+	if renewable {
+		renewed, err := p.renew(ctx, lease)
+		switch {
+		case err != nil:
+			log.Warnf("Unable to renew Vault lease %q, obtaining new credentials: %v", lease.ID, err)
+		case renewed.Duration*3 < lease.Duration:
+			// The lease is close to its maximum TTL.
+			log.Infof("Vault lease %q can no longer be renewed for long, obtaining new credentials", lease.ID)
+		default:
+			p.mtx.Lock()
+			defer p.mtx.Unlock()
+			p.credentials.Expiry = now.Add(time.Duration(renewed.Duration) * time.Second)
+			p.refreshAt = refreshTime(now, p.credentials.Expiry)
+			p.lease.Renewable = renewed.Renewable
+			log.Debugf("Renewed Vault lease %q for %ds", lease.ID, renewed.Duration)
+			return p.credentials, nil
+		}
+	}
+
+	var secret struct {
+		vaultLease
+		Data struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"data"`
+	}
+	if err := p.request(ctx, http.MethodGet, "/v1/"+p.mount+"/creds/"+p.role, nil, &secret); err != nil {
+		return Credentials{}, err
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.lease, p.valid = secret.vaultLease, true
+	p.credentials = Credentials{User: secret.Data.Username, Password: secret.Data.Password}
+	if p.lease.Duration > 0 {
+		p.credentials.Expiry = now.Add(time.Duration(p.lease.Duration) * time.Second)
+	}
+	p.refreshAt = refreshTime(now, p.credentials.Expiry)
+	log.Infof("Obtained credentials for role %q from Vault, lease %q for %ds", p.role, p.lease.ID, p.lease.Duration)
+	return p.credentials, nil
+}
+
+// Invalidate makes the next call obtain new credentials, rather than renew
+// the lease of the rejected ones.
+func (p *vaultSecretProvider) Invalidate(c Credentials) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if c.equal(p.credentials) {
+		p.valid = false
+	}
+}
+
+// Renew the lease of the credentials for its original duration.
+func (p *vaultSecretProvider) renew(ctx context.Context, lease vaultLease) (vaultLease, error) {
+	var renewed vaultLease
+	body := map[string]interface{}{"lease_id": lease.ID, "increment": lease.Duration}
+	err := p.request(ctx, http.MethodPut, "/v1/sys/leases/renew", body, &renewed)
+	return renewed, err
+}
+
+// Send a request to Vault and decode its JSON response into out.
+func (p *vaultSecretProvider) request(ctx context.Context, method, path string, body, out interface{}) error {
+	token := p.token
+	if p.tokenFile != "" {
+		// Read on every request, as agents rotate the token.
+		content, err := ioutil.ReadFile(p.tokenFile)
+		if err != nil {
+			return fmt.Errorf("Error reading Vault token: %v", err)
+		}
+		token = strings.TrimSpace(string(content))
+	}
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, p.address+path, &reqBody)
+	if err != nil {
+		return fmt.Errorf("Error creating Vault request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Vault-Token", token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error requesting %s from Vault: %v", path, err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&vaultErr) // nolint: errcheck
+		return fmt.Errorf("Error requesting %s from Vault: %s: %s", path, resp.Status, strings.Join(vaultErr.Errors, ", "))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("Error decoding %s from Vault: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+// +build !integration
+
+package pgxexporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type VaultSuite struct{}
+
+var _ = Suite(&VaultSuite{})
+
+// mockVault serves the database secrets engine and lease renewal endpoints.
+type mockVault struct {
+	mtx sync.Mutex
+	// Credentials issued so far, and lease renewals
+	issued, renewals int
+	// Lease duration granted to the next renewal
+	renewDuration int64
+	// If set, requests are signalled on requested and wait for release
+	requested chan struct{}
+	release   chan struct{}
+}
+
+func (v *mockVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if v.release != nil {
+		v.requested <- struct{}{}
+		<-v.release
+	}
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	if r.Header.Get("X-Vault-Token") != "s.token" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/database/creds/exporter":
+		v.issued++
+		fmt.Fprintf(w, `{"lease_id": "database/creds/exporter/%d", "lease_duration": 3600, "renewable": true,
+			"data": {"username": "v-exporter-%d", "password": "secret-%d"}}`, v.issued, v.issued, v.issued)
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/sys/leases/renew":
+		var body struct {
+			LeaseID   string `json:"lease_id"`
+			Increment int64  `json:"increment"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Increment != 3600 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		v.renewals++
+		fmt.Fprintf(w, `{"lease_id": %q, "lease_duration": %d, "renewable": true}`, body.LeaseID, v.renewDuration)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors": []}`)
+	}
+}
+
+func (s *VaultSuite) TestVaultSecretProvider(c *C) {
+	vault := &mockVault{renewDuration: 3600}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	tokenFile := filepath.Join(c.MkDir(), "token")
+	c.Assert(ioutil.WriteFile(tokenFile, []byte("s.token\n"), 0600), IsNil)
+	p, err := newVaultSecretProvider(VaultSecretsConfig{Address: server.URL + "/", TokenFile: tokenFile, Role: "exporter"})
+	c.Assert(err, IsNil)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	credentials, err := p.Credentials(ctx)
+	c.Assert(err, IsNil)
+	c.Check(credentials.User, Equals, "v-exporter-1")
+	c.Check(credentials.Password, Equals, "secret-1")
+	c.Check(credentials.Expiry.Equal(now.Add(time.Hour)), Equals, true)
+
+	// Cached until a third of the lease is left.
+	now = now.Add(30 * time.Minute)
+	credentials, err = p.Credentials(ctx)
+	c.Assert(err, IsNil)
+	c.Check(credentials.Password, Equals, "secret-1")
+	c.Check(vault.issued, Equals, 1)
+	c.Check(vault.renewals, Equals, 0)
+
+	// Then the lease is renewed, keeping the credentials.
+	now = now.Add(15 * time.Minute)
+	credentials, err = p.Credentials(ctx)
+	c.Assert(err, IsNil)
+	c.Check(credentials.Password, Equals, "secret-1")
+	c.Check(credentials.Expiry.Equal(now.Add(time.Hour)), Equals, true)
+	c.Check(vault.renewals, Equals, 1)
+
+	// Near its maximum TTL the lease is renewed for less, and replaced.
+	vault.renewDuration = 600
+	now = now.Add(45 * time.Minute)
+	credentials, err = p.Credentials(ctx)
+	c.Assert(err, IsNil)
+	c.Check(credentials.Password, Equals, "secret-2")
+	c.Check(vault.renewals, Equals, 2)
+
+	// Rejected credentials are replaced rather than renewed.
+	p.Invalidate(credentials)
+	credentials, err = p.Credentials(ctx)
+	c.Assert(err, IsNil)
+	c.Check(credentials.Password, Equals, "secret-3")
+	c.Check(vault.renewals, Equals, 2)
+
+	c.Assert(ioutil.WriteFile(tokenFile, []byte("s.revoked"), 0600), IsNil)
+	p.Invalidate(credentials)
+	_, err = p.Credentials(ctx)
+	c.Check(err, ErrorMatches, `Error requesting /v1/database/creds/exporter from Vault: 403 Forbidden: permission denied`)
+
+	p, err = newVaultSecretProvider(VaultSecretsConfig{Address: server.URL, TokenFile: tokenFile, Mount: "postgres", Role: "exporter"})
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(tokenFile, []byte("s.token"), 0600), IsNil)
+	_, err = p.Credentials(ctx)
+	c.Check(err, ErrorMatches, `Error requesting /v1/postgres/creds/exporter from Vault: 404 Not Found: `)
+}
+
+func (s *VaultSuite) TestVaultSecretProviderSingleFlight(c *C) {
+	vault := &mockVault{renewDuration: 3600, requested: make(chan struct{}, 10), release: make(chan struct{})}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	tokenFile := filepath.Join(c.MkDir(), "token")
+	c.Assert(ioutil.WriteFile(tokenFile, []byte("s.token"), 0600), IsNil)
+	p, err := newVaultSecretProvider(VaultSecretsConfig{Address: server.URL, TokenFile: tokenFile, Role: "exporter"})
+	c.Assert(err, IsNil)
+
+	var wg sync.WaitGroup
+	passwords := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			credentials, err := p.Credentials(context.Background())
+			c.Check(err, IsNil)
+			passwords <- credentials.Password
+		}()
+	}
+
+	// The request in flight does not hold the lock.
+	<-vault.requested
+	p.Invalidate(Credentials{User: "other"})
+	close(vault.release)
+	wg.Wait()
+	close(passwords)
+
+	for password := range passwords {
+		c.Check(password, Equals, "secret-1")
+	}
+	c.Check(vault.issued, Equals, 1)
+	c.Check(vault.requested, HasLen, 0)
+}
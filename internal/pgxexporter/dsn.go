@@ -0,0 +1,110 @@
+package pgxexporter
+
+import (
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Report whether the DSN is in URL form rather than key/value form.
+func isURLDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// Report whether the host is the directory of a Unix domain socket.
+func isSocketHost(host string) bool {
+	return strings.HasPrefix(host, "/")
+}
+
+// Settings of a key/value connection string, values optionally single quoted.
+var connStringSettingRegex = regexp.MustCompile(`(\w+)\s*=\s*('(?:[^'\\]|\\.)*'|\S*)`)
+
+// Parse the settings of a connection string in URL or key/value form, as far
+// as needed to look them up. Malformed connection strings are left to pgx to
+// report.
+func parseConnStringSettings(dsn string) map[string]string {
+	settings := make(map[string]string)
+	if isURLDSN(dsn) {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return settings
+		}
+		for k, v := range u.Query() {
+			settings[k] = v[0]
+		}
+		return settings
+	}
+
+	for _, match := range connStringSettingRegex.FindAllStringSubmatch(dsn, -1) {
+		value := match[2]
+		if strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") && len(value) > 1 {
+			value = strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(value[1 : len(value)-1])
+		}
+		settings[match[1]] = value
+	}
+	return settings
+}
+
+// Quote a value of a key/value connection string.
+func quoteConnStringValue(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// Return the DSN connecting to another database of the same server, in the
+// form of the given DSN. Key/value DSNs, such as those referring to a service,
+// get a dbname setting overriding the earlier ones.
+func dsnWithDatabase(dsn, database string) (string, error) {
+	if isURLDSN(dsn) {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", err
+		}
+		// Without a host, as with sockets, the path is not made absolute.
+		u.Path = "/" + database
+		return u.String(), nil
+	}
+	return dsn + " dbname=" + quoteConnStringValue(database), nil
+}
+
+// Return the DSN connecting to host instead, keeping the port and every other
+// parameter. The host may be the directory of a Unix domain socket, as in
+// "/var/run/postgresql", which is given as the host parameter of URLs.
+func dsnWithHost(dsn, host string) (string, error) {
+	if !isURLDSN(dsn) {
+		return dsn + " host=" + quoteConnStringValue(host), nil
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	// Of multiple hosts, the port of the first is kept.
+	var port string
+	if first := strings.Split(u.Host, ",")[0]; strings.Contains(first, ":") {
+		if _, port, err = net.SplitHostPort(first); err != nil {
+			return "", err
+		}
+	}
+
+	query := u.Query()
+	query.Del("host")
+	if isSocketHost(host) {
+		u.Host = ""
+		if port != "" {
+			u.Host = ":" + port
+		}
+		query.Set("host", host)
+	} else {
+		switch {
+		case port != "":
+			u.Host = net.JoinHostPort(host, port)
+		case strings.Contains(host, ":"):
+			u.Host = "[" + host + "]"
+		default:
+			u.Host = host
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
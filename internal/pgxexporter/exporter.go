@@ -8,7 +8,6 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"io/ioutil"
-	"net/url"
 	"time"
 )
 
@@ -51,6 +50,37 @@ type Exporter struct {
 
 	excludeDatabases []string
 	dsn              []string
+
+	// Bounds on the per relation namespaces, which can otherwise emit a series
+	// for every table of a heavily partitioned schema.
+	relationSizeThreshold int64
+	relationTopN          int
+
+	// Backends idle in transaction for longer than this hold back vacuum and
+	// are counted separately.
+	idleInTransactionThreshold time.Duration
+
+	// pg_buffercache is expensive to scan, so it is opt-in and cached.
+	collectBufferCache      bool
+	bufferCacheInterval     time.Duration
+	bufferCacheRelationTopN int
+
+	// String and enum settings exported by pg_settings_info
+	settingsInfoAllowlist []string
+	settingsSourceLabels  bool
+
+	// Options from the configuration file and the flags merged into it
+	config Config
+
+	// Files the credentials of the data sources of the environment are read
+	// from, if any
+	credentialUserFile, credentialPassFile string
+
+	// Secret providers of the data sources of the environment and of the
+	// configured targets, shared by the servers of each
+	envSecrets    SecretProvider
+	targetSecrets map[string]SecretProvider
+
 	userQueriesPath  string
 	constantLabels   prometheus.Labels
 	duration         prometheus.Gauge
@@ -58,6 +88,8 @@ type Exporter struct {
 	psqlUp           prometheus.Gauge
 	userQueriesError *prometheus.GaugeVec
 	totalScrapes     prometheus.Counter
+	unknownUnits     prometheus.Counter
+	credentialReload prometheus.Counter
 
 	// servers are used to allow re-using the DB connection between scrapes.
 	// servers contains metrics map and query overrides.
@@ -75,6 +107,13 @@ func NewExporter(dsn []string, opts ...ExporterOpt) *Exporter {
 		opt(e)
 	}
 
+	for _, target := range e.config.Targets {
+		if !contains(e.dsn, target.ConnString()) {
+			e.dsn = append(e.dsn, target.ConnString())
+		}
+	}
+	e.setupSecretProviders()
+
 	e.setupInternalMetrics()
 	e.setupServers()
 
@@ -93,55 +132,45 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 	ch <- e.totalScrapes
 	ch <- e.error
 	ch <- e.psqlUp
+	ch <- e.unknownUnits
+	ch <- e.credentialReload
 	e.userQueriesError.Collect(ch)
+	e.servers.collectStats(ch)
 }
 
 // Describe implements prometheus.Collector.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	// We cannot know in advance what metrics the exporter will generate
-	// from Postgres. So we use the poor man's describe method: Run a collect
-	// and send the descriptors of all the collected metrics. The problem
-	// here is that we need to connect to the Postgres DB. If it is currently
-	// unavailable, the descriptors will be incomplete. Since this is a
-	// stand-alone exporter and not used as a library within other code
-	// implementing additional metrics, the worst that can happen is that we
-	// don't detect inconsistent metrics created by this exporter
-	// itself. Also, a change in the monitored Postgres instance may change the
-	// exported metrics during the runtime of the exporter.
-	metricCh := make(chan prometheus.Metric)
-	doneCh := make(chan struct{})
-
-	go func() {
-		for m := range metricCh {
-			ch <- m.Desc()
-		}
-		close(doneCh)
-	}()
-
-	e.Collect(metricCh)
-	close(metricCh)
-	<-doneCh
+	// from Postgres, and finding out would mean connecting to every target
+	// when the exporter is registered, delaying startup for as long as they
+	// are unreachable. Sending no descriptors registers the exporter as an
+	// unchecked collector instead, so it is only scraped when collected.
 }
 
 // Check and update the exporters query maps if the version has changed.
 func (e *Exporter) checkMapVersions(ch chan<- prometheus.Metric, server *Server) error {
 	ctx := context.Background()
-	conn, err := server.db.Acquire(context.Background())
+	conn, err := server.acquire(context.Background())
 	if err != nil {
-		log.Errorf("unable to acquire db connect: %v", err)
-		return err
+		return &ErrorConnectToServer{fmt.Sprintf("Error opening connection to database (%s): %s", server, err)}
 	}
 	defer conn.Release()
 
 	log.Debugf("Querying Postgres Version on %q", server)
-	versionRow := conn.Conn().QueryRow(ctx, "SELECT version();")
-	var versionString string
-	err = versionRow.Scan(&versionString)
+	versionRow := conn.Conn().QueryRow(ctx, "SELECT current_setting('server_version_num'), current_setting('server_version'), version();")
+	var versionNum, serverVersion, versionString string
+	err = versionRow.Scan(&versionNum, &serverVersion, &versionString)
 	if err != nil {
 		log.Debugf("unable to select version: %v", err)
 		return fmt.Errorf("Error scanning version string on %q: %v", server, err)
 	}
-	semanticVersion, err := parseVersion(versionString)
+	// server_version_num is reliable across forks and pre-releases, where
+	// the banner returned by version() is not.
+	semanticVersion, err := parseVersionNum(versionNum)
+	if err != nil {
+		log.Debugf("unable to parse server_version_num, falling back to server_version: %v", err)
+		semanticVersion, err = parseServerVersion(serverVersion)
+	}
 	if err != nil {
 		log.Debugf("unable to parse semantic version: %v", err)
 		return fmt.Errorf("Error parsing version string on %q: %v", server, err)
@@ -149,21 +178,40 @@ func (e *Exporter) checkMapVersions(ch chan<- prometheus.Metric, server *Server)
 	if !e.disableDefaultMetrics && semanticVersion.LT(lowestSupportedVersion) {
 		log.Warnf("PostgreSQL version is lower on %q then our lowest supported version! Got %s minimum supported is %s.", server, semanticVersion, lowestSupportedVersion)
 	}
+	flavour := parseFlavour(versionString)
 
-	// Check if semantic version changed and recalculate maps if needed.
-	if semanticVersion.NE(server.lastMapVersion) || server.metricMap == nil {
-		log.Infof("Semantic Version Changed on %q: %s -> %s", server, server.lastMapVersion, semanticVersion)
+	// Check if semantic version or flavour changed and recalculate maps if needed.
+	if semanticVersion.NE(server.lastMapVersion) || flavour != server.lastMapFlavour || server.metricMap == nil {
+		log.Infof("Semantic Version Changed on %q: %s -> %s (%s)", server, server.lastMapVersion, semanticVersion, flavour)
 		server.mappingMtx.Lock()
 
+		caps, err := probeCapabilities(ctx, conn.Conn())
+		if err != nil {
+			// Without capabilities only the version and flavour gate namespaces.
+			log.Warnf("Unable to probe capabilities on %q: %v", server, err)
+		}
+		server.capabilities = caps
+
 		if e.disableDefaultMetrics {
 			server.metricMap = make(map[string]MetricMapNamespace)
 			server.queryOverrides = make(map[string]string)
+			server.queryArgs = make(map[string][]interface{})
+			server.cacheIntervals = make(map[string]time.Duration)
 		} else {
 			server.metricMap = makeDescMap(semanticVersion, server.labels, e.builtinMetricMaps)
 			server.queryOverrides = makeQueryOverrideMap(semanticVersion, queryOverrides)
+			server.queryArgs = e.makeQueryArgs()
+			server.cacheIntervals = e.makeCacheIntervals()
+			removeUnsupportedNamespaces(flavour, caps, server.metricMap, server.queryOverrides)
+			for _, namespace := range e.disabledNamespaces() {
+				delete(server.metricMap, namespace)
+				delete(server.queryOverrides, namespace)
+			}
 		}
+		server.resetMetricCache()
 
 		server.lastMapVersion = semanticVersion
+		server.lastMapFlavour = flavour
 
 		if e.userQueriesPath != "" {
 			// Clear the metric while a reload is happening
@@ -192,11 +240,50 @@ func (e *Exporter) checkMapVersions(ch chan<- prometheus.Metric, server *Server)
 
 	// Output the version as a special metric
 	versionDesc := prometheus.NewDesc(fmt.Sprintf("%s_%s", namespace, staticLabelName),
-		"Version string as reported by postgres", []string{"version", "short_version"}, server.labels)
+		"Version string as reported by postgres", []string{"version", "short_version", "flavour"}, server.labels)
 
 	if !e.disableDefaultMetrics {
 		ch <- prometheus.MustNewConstMetric(versionDesc,
-			prometheus.UntypedValue, 1, versionString, semanticVersion.String())
+			prometheus.UntypedValue, 1, versionString, semanticVersion.String(), flavour)
+	}
+	return nil
+}
+
+// Build the arguments for the builtin override queries which take them, in
+// the order of their placeholders.
+func (e *Exporter) makeQueryArgs() map[string][]interface{} {
+	return map[string][]interface{}{
+		"pg_stat_activity_detail": {e.idleInTransactionThreshold.Seconds()},
+		"pg_table_size":           {e.relationSizeThreshold, limitArg(e.relationTopN)},
+		"pg_table_bloat":          {e.relationSizeThreshold, limitArg(e.relationTopN)},
+		"pg_index_unused":         {e.relationSizeThreshold, limitArg(e.relationTopN)},
+		"pg_buffercache_relation": {limitArg(e.bufferCacheRelationTopN)},
+	}
+}
+
+// The argument of a LIMIT placeholder for at most n rows, where 0 means no
+// limit. A LIMIT of NULL is the same as no limit at all.
+func limitArg(n int) interface{} {
+	if n > 0 {
+		return int64(n)
+	}
+	return nil
+}
+
+// Cache intervals of the builtin namespaces which are too expensive to query
+// on every scrape.
+func (e *Exporter) makeCacheIntervals() map[string]time.Duration {
+	intervals := make(map[string]time.Duration)
+	for _, namespace := range bufferCacheNamespaces {
+		intervals[namespace] = e.bufferCacheInterval
+	}
+	return intervals
+}
+
+// Builtin namespaces of collectors which have not been enabled.
+func (e *Exporter) disabledNamespaces() []string {
+	if !e.collectBufferCache {
+		return bufferCacheNamespaces
 	}
 	return nil
 }
@@ -208,16 +295,36 @@ func (e *Exporter) scrape(ch chan<- prometheus.Metric) {
 
 	e.totalScrapes.Inc()
 
-	dsns := e.dsn
+	// DSNs to scrape, in the order configured, each followed by the
+	// databases found by --auto-discover-databases through it
+	dsns := make([]scrapedDSN, 0, len(e.dsn))
+	for _, dsn := range e.dsn {
+		dsns = append(dsns, scrapedDSN{dsn: dsn, target: dsn})
+	}
 	if e.autoDiscoverDatabases {
 		dsns = e.discoverDatabaseDSNs()
 	}
+	scraped := make(map[string]bool, len(dsns))
+	for _, d := range dsns {
+		scraped[d.dsn] = true
+	}
+	e.servers.prune(func(dsn string) bool {
+		return scraped[dsn]
+	})
 
 	var errorsCount int
 	var connectionErrorsCount int
 
-	for _, dsn := range dsns {
-		if err := e.scrapeDSN(ch, dsn); err != nil {
+	for _, d := range dsns {
+		var kinds dsnKind
+		if d.dsn == d.target {
+			kinds |= dsnTarget
+		}
+		if d.discovered {
+			kinds |= dsnDiscoveredDatabase
+		}
+
+		if err := e.scrapeDSN(ch, d.dsn, d.target, kinds); err != nil {
 			errorsCount++
 
 			log.Errorf(err.Error())
@@ -243,17 +350,22 @@ func (e *Exporter) scrape(ch chan<- prometheus.Metric) {
 	}
 }
 
-func (e *Exporter) discoverDatabaseDSNs() []string {
-	dsns := make(map[string]struct{})
-	for _, dsn := range e.dsn {
-		parsedDSN, err := url.Parse(dsn)
-		if err != nil {
-			log.Errorf("Unable to parse DSN (%s): %v", loggableDSN(dsn), err)
-			continue
-		}
+// scrapedDSN is a DSN to scrape, with the configured DSN it belongs to.
+type scrapedDSN struct {
+	dsn, target string
+	// Whether it was found by --auto-discover-databases
+	discovered bool
+}
 
-		dsns[dsn] = struct{}{}
-		server, err := e.servers.GetServer(dsn)
+// Discover the databases of the configured DSNs, returning the configured DSNs
+// in order, each followed by the DSNs of the databases discovered from it.
+// The DSN of a database is the configured DSN itself when it already names
+// the database, and is only scraped once.
+func (e *Exporter) discoverDatabaseDSNs() []scrapedDSN {
+	var dsns []scrapedDSN
+	for _, dsn := range e.dsn {
+		dsns = appendScrapedDSN(dsns, scrapedDSN{dsn: dsn, target: dsn})
+		server, err := e.servers.GetServer(dsn, e.targetServerOpts(dsn)...)
 		if err != nil {
 			log.Errorf("Error opening connection to database (%s): %v", loggableDSN(dsn), err)
 			continue
@@ -269,34 +381,133 @@ func (e *Exporter) discoverDatabaseDSNs() []string {
 				log.Debugf("database is being excluded: %s", databaseName)
 				continue
 			}
-			parsedDSN.Path = databaseName
-			dsns[parsedDSN.String()] = struct{}{}
+			databaseDSN, err := dsnWithDatabase(dsn, databaseName)
+			if err != nil {
+				log.Errorf("Unable to parse DSN (%s): %v", loggableDSN(dsn), err)
+				break
+			}
+			dsns = appendScrapedDSN(dsns, scrapedDSN{dsn: databaseDSN, target: dsn, discovered: true})
+		}
+	}
+
+	return dsns
+}
+
+// Append a DSN to scrape unless it is already listed, in which case the entry
+// is merged into the listed one: it is discovered if either is, and belongs to
+// itself if it is a configured DSN.
+func appendScrapedDSN(dsns []scrapedDSN, d scrapedDSN) []scrapedDSN {
+	for i := range dsns {
+		if dsns[i].dsn != d.dsn {
+			continue
 		}
+		dsns[i].discovered = dsns[i].discovered || d.discovered
+		if d.dsn == d.target {
+			dsns[i].target = d.target
+		}
+		return dsns
 	}
+	return append(dsns, d)
+}
 
-	result := make([]string, len(dsns))
-	index := 0
-	for dsn := range dsns {
-		result[index] = dsn
-		index++
+// Options of the servers of a configured DSN, from the configuration file.
+func (e *Exporter) targetServerOpts(target string) []ServerOpt {
+	pool := e.config.Pool
+	session := e.config.Session
+	tls := e.config.TLS
+	secrets := e.envSecrets
+	for _, t := range e.config.Targets {
+		if t.ConnString() == target {
+			pool = pool.merge(t.Pool)
+			session = session.merge(t.Session)
+			if t.TLS != nil {
+				tls = t.TLS
+			}
+			secrets = e.targetSecrets[target]
+			break
+		}
 	}
 
-	return result
+	return []ServerOpt{
+		ServerWithPoolConfig(pool),
+		ServerWithSessionConfig(session),
+		ServerWithTLSConfig(tls),
+		ServerWithSecretProvider(secrets, e.credentialReload),
+	}
 }
 
-func (e *Exporter) scrapeDSN(ch chan<- prometheus.Metric, dsn string) error {
-	server, err := e.servers.GetServer(dsn)
+// Create the secret providers of the configuration file, and of the credential
+// files for the data sources of the environment if it has none. Only the data
+// sources of the environment take their credentials from the credential files.
+func (e *Exporter) setupSecretProviders() {
+	newProvider := func(c *SecretsConfig) SecretProvider {
+		if c == nil {
+			return nil
+		}
+		p, err := c.provider()
+		if err != nil {
+			log.Errorf("Unable to create secret provider: %v", err)
+			return nil
+		}
+		return p
+	}
+
+	global := newProvider(e.config.Secrets)
+	e.envSecrets = global
+	if global == nil && (e.credentialUserFile != "" || e.credentialPassFile != "") {
+		e.envSecrets = newFileSecretProvider(e.credentialUserFile, e.credentialPassFile)
+	}
+
+	e.targetSecrets = make(map[string]SecretProvider)
+	for _, t := range e.config.Targets {
+		e.targetSecrets[t.ConnString()] = global
+		if t.Secrets != nil {
+			e.targetSecrets[t.ConnString()] = newProvider(t.Secrets)
+		}
+	}
+}
+
+// TargetReadiness is whether a target accepts connections, and why not.
+type TargetReadiness struct {
+	Target string `json:"target"`
+	Ready  bool   `json:"ready"`
+	Error  string `json:"error,omitempty"`
+}
+
+// CheckReadiness reports which configured targets, not the discovered
+// databases, are ready, from the outcome of the last attempt to connect to
+// them and their circuit breakers. It does not connect, so targets are only
+// ready once scraped.
+func (e *Exporter) CheckReadiness() []TargetReadiness {
+	readiness := make([]TargetReadiness, 0, len(e.dsn))
+	for _, dsn := range e.dsn {
+		r := TargetReadiness{Target: loggableDSN(dsn), Ready: true}
+		if err := e.servers.readiness(dsn); err != nil {
+			r.Ready = false
+			r.Error = redactDSNError(dsn, err).Error()
+		}
+		readiness = append(readiness, r)
+	}
+	return readiness
+}
+
+func (e *Exporter) scrapeDSN(ch chan<- prometheus.Metric, dsn, target string, kinds dsnKind) error {
+	server, err := e.servers.GetServer(dsn, e.targetServerOpts(target)...)
 	if err != nil {
-		log.Debugf("Get of the server for dsn failed: %s", dsn)
+		log.Debugf("Get of the server for dsn failed: %s", loggableDSN(dsn))
 		return &ErrorConnectToServer{fmt.Sprintf("Error opening connection to database (%s): %s", loggableDSN(dsn), err)}
 	}
 
-	// Check if map versions need to be updated
+	// Check if map versions need to be updated. This is the first use of the
+	// server in the scrape, so the DSN is not scraped if it cannot connect.
 	if err := e.checkMapVersions(ch, server); err != nil {
+		if _, ok := err.(*ErrorConnectToServer); ok {
+			return err
+		}
 		log.Warnln("Proceeding with outdated query maps, as the Postgres version could not be determined:", err)
 	}
 
-	return server.Scrape(ch, e.disableSettingsMetrics)
+	return server.Scrape(ch, e.disableSettingsMetrics, kinds)
 }
 
 // TODO: revisit this with the semver system
@@ -319,7 +530,15 @@ func (e *Exporter) dumpMaps() {
 }
 
 func (e *Exporter) setupServers() {
-	e.servers = NewServers(ServerWithLabels(e.constantLabels))
+	e.servers = NewServers(
+		ServerWithLabels(e.constantLabels),
+		ServerWithSettingsInfo(e.settingsInfoAllowlist),
+		ServerWithSettingsSourceLabels(e.settingsSourceLabels),
+		ServerWithSettingsUnknownUnits(e.unknownUnits),
+		ServerWithSettingsFilter(e.config.Settings.Include, e.config.Settings.Exclude),
+	)
+	e.servers.labels = e.constantLabels
+	e.servers.backoff = e.servers.backoff.merge(e.config.Backoff)
 }
 
 func (e *Exporter) setupInternalMetrics() {
@@ -350,6 +569,20 @@ func (e *Exporter) setupInternalMetrics() {
 		Help:        "Whether the last scrape of metrics from PostgreSQL was able to connect to the server (1 for yes, 0 for no).",
 		ConstLabels: e.constantLabels,
 	})
+	e.unknownUnits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   exporter,
+		Name:        "settings_unknown_units_total",
+		Help:        "Total number of settings exported without converting their unit, because it is not known to the exporter.",
+		ConstLabels: e.constantLabels,
+	})
+	e.credentialReload = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   exporter,
+		Name:        "credential_reloads_total",
+		Help:        "Total number of times changed credentials were obtained from a secret provider and the connection pools rebuilt.",
+		ConstLabels: e.constantLabels,
+	})
 	e.userQueriesError = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace:   namespace,
 		Subsystem:   exporter,
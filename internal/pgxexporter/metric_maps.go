@@ -60,6 +60,43 @@ var builtinMetricMaps = map[string]map[string]ColumnMapping{
 		"buffers_backend_fsync": {COUNTER, "Number of times a backend had to execute its own fsync call (normally the background writer handles those even when the backend does its own write)", nil, nil},
 		"buffers_alloc":         {COUNTER, "Number of buffers allocated", nil, nil},
 		"stats_reset":           {COUNTER, "Time at which these statistics were last reset", nil, nil},
+		"restartpoints_timed":   {COUNTER, "Number of scheduled restartpoints due to timeout or after a failed attempt to perform it", nil, semver.MustParseRange(">=17.0.0")},
+		"restartpoints_req":     {COUNTER, "Number of requested restartpoints", nil, semver.MustParseRange(">=17.0.0")},
+		"restartpoints_done":    {COUNTER, "Number of restartpoints that have been performed", nil, semver.MustParseRange(">=17.0.0")},
+	},
+	"pg_stat_wal": {
+		"wal_records":      {COUNTER, "Total number of WAL records generated", nil, nil},
+		"wal_fpi":          {COUNTER, "Total number of WAL full page images generated", nil, nil},
+		"wal_bytes":        {COUNTER, "Total amount of WAL generated in bytes", nil, nil},
+		"wal_buffers_full": {COUNTER, "Number of times WAL data was written to disk because WAL buffers became full", nil, nil},
+		"wal_write":        {COUNTER, "Number of times WAL buffers were written out to disk", nil, semver.MustParseRange("<18.0.0")},
+		"wal_sync":         {COUNTER, "Number of times WAL files were synced to disk", nil, semver.MustParseRange("<18.0.0")},
+		"wal_write_time":   {COUNTER, "Total amount of time spent writing WAL buffers to disk, in milliseconds (if track_wal_io_timing is enabled, otherwise zero)", nil, semver.MustParseRange("<18.0.0")},
+		"wal_sync_time":    {COUNTER, "Total amount of time spent syncing WAL files to disk, in milliseconds (if track_wal_io_timing is enabled, otherwise zero)", nil, semver.MustParseRange("<18.0.0")},
+		"stats_reset":      {COUNTER, "Time at which these statistics were last reset", nil, nil},
+	},
+	"pg_stat_io": {
+		"backend_type":   {LABEL, "Type of backend", nil, nil},
+		"object":         {LABEL, "Target object of an I/O operation", nil, nil},
+		"context":        {LABEL, "The context of an I/O operation", nil, nil},
+		"reads":          {COUNTER, "Number of read operations", nil, nil},
+		"read_bytes":     {COUNTER, "The total size of read operations in bytes", nil, semver.MustParseRange(">=18.0.0")},
+		"read_time":      {COUNTER, "Time spent in read operations in milliseconds (if track_io_timing is enabled, otherwise zero)", nil, nil},
+		"writes":         {COUNTER, "Number of write operations", nil, nil},
+		"write_bytes":    {COUNTER, "The total size of write operations in bytes", nil, semver.MustParseRange(">=18.0.0")},
+		"write_time":     {COUNTER, "Time spent in write operations in milliseconds (if track_io_timing is enabled, otherwise zero)", nil, nil},
+		"writebacks":     {COUNTER, "Number of units of size BLCKSZ which the process requested the kernel write out to permanent storage", nil, nil},
+		"writeback_time": {COUNTER, "Time spent in writeback operations in milliseconds (if track_io_timing is enabled, otherwise zero)", nil, nil},
+		"extends":        {COUNTER, "Number of relation extend operations", nil, nil},
+		"extend_bytes":   {COUNTER, "The total size of relation extend operations in bytes", nil, semver.MustParseRange(">=18.0.0")},
+		"extend_time":    {COUNTER, "Time spent in extend operations in milliseconds (if track_io_timing is enabled, otherwise zero)", nil, nil},
+		"op_bytes":       {GAUGE, "The number of bytes per unit of I/O read, written, or extended", nil, semver.MustParseRange("<18.0.0")},
+		"hits":           {COUNTER, "The number of times a desired block was found in a shared buffer", nil, nil},
+		"evictions":      {COUNTER, "Number of times a block has been written out from a shared or local buffer in order to make it available for another use", nil, nil},
+		"reuses":         {COUNTER, "The number of times an existing buffer in a size-limited ring buffer outside of shared buffers was reused", nil, nil},
+		"fsyncs":         {COUNTER, "Number of fsync calls", nil, nil},
+		"fsync_time":     {COUNTER, "Time spent in fsync operations in milliseconds (if track_io_timing is enabled, otherwise zero)", nil, nil},
+		"stats_reset":    {COUNTER, "Time at which these statistics were last reset", nil, nil},
 	},
 	"pg_stat_database": {
 		"datid":          {LABEL, "OID of a database", nil, nil},
@@ -143,6 +180,319 @@ var builtinMetricMaps = map[string]map[string]ColumnMapping{
 		"count":           {GAUGE, "number of connections in this state", nil, nil},
 		"max_tx_duration": {GAUGE, "max duration in seconds any active transaction has been running", nil, nil},
 	},
+	"pg_stat_activity_detail": {
+		"datname":                            {LABEL, "Name of this database", nil, nil},
+		"usename":                            {LABEL, "Name of the user logged into these backends", nil, nil},
+		"application_name":                   {LABEL, "Name of the application that is connected to these backends", nil, nil},
+		"wait_event_type":                    {LABEL, "The type of event for which the backends are waiting, if any", nil, nil},
+		"max_query_duration":                 {GAUGE, "max duration in seconds any active query has been running", nil, nil},
+		"max_state_duration":                 {GAUGE, "max duration in seconds any backend which is not idle has been in its current state", nil, nil},
+		"idle_in_transaction_over_threshold": {GAUGE, "number of backends idle in transaction for longer than the configured threshold", nil, nil},
+	},
+	"pg_stat_progress_vacuum": {
+		"pid":                  {LABEL, "Process ID of backend", nil, nil},
+		"datid":                {DISCARD, "OID of the database to which this backend is connected", nil, nil},
+		"datname":              {LABEL, "Name of the database to which this backend is connected", nil, nil},
+		"relid":                {DISCARD, "OID of the table being vacuumed", nil, nil},
+		"relname":              {LABEL, "Name of the table being vacuumed", nil, nil},
+		"phase":                {LABEL, "Current processing phase of vacuum", nil, nil},
+		"heap_blks_total":      {GAUGE, "Total number of heap blocks in the table", nil, nil},
+		"heap_blks_scanned":    {GAUGE, "Number of heap blocks scanned", nil, nil},
+		"heap_blks_vacuumed":   {GAUGE, "Number of heap blocks vacuumed", nil, nil},
+		"index_vacuum_count":   {GAUGE, "Number of completed index vacuum cycles", nil, nil},
+		"max_dead_tuples":      {GAUGE, "Number of dead tuples that we can store before needing to perform an index vacuum cycle", nil, semver.MustParseRange("<17.0.0")},
+		"num_dead_tuples":      {GAUGE, "Number of dead tuples collected since the last index vacuum cycle", nil, semver.MustParseRange("<17.0.0")},
+		"max_dead_tuple_bytes": {GAUGE, "Amount of dead tuple data that we can store before needing to perform an index vacuum cycle", nil, semver.MustParseRange(">=17.0.0")},
+		"dead_tuple_bytes":     {GAUGE, "Amount of dead tuple data collected since the last index vacuum cycle", nil, semver.MustParseRange(">=17.0.0")},
+		"num_dead_item_ids":    {GAUGE, "Number of dead item identifiers collected since the last index vacuum cycle", nil, semver.MustParseRange(">=17.0.0")},
+		"indexes_total":        {GAUGE, "Total number of indexes that will be vacuumed or cleaned up", nil, semver.MustParseRange(">=17.0.0")},
+		"indexes_processed":    {GAUGE, "Number of indexes processed in the current phase", nil, semver.MustParseRange(">=17.0.0")},
+		"delay_time":           {GAUGE, "Total time spent sleeping due to cost-based delay, in milliseconds", nil, semver.MustParseRange(">=18.0.0")},
+		"progress_ratio":       {GAUGE, "Fraction of the heap blocks processed in the current phase (0-1)", nil, nil},
+	},
+	"pg_stat_progress_create_index": {
+		"pid":                {LABEL, "Process ID of backend", nil, nil},
+		"datid":              {DISCARD, "OID of the database to which this backend is connected", nil, nil},
+		"datname":            {LABEL, "Name of the database to which this backend is connected", nil, nil},
+		"relid":              {DISCARD, "OID of the table on which the index is being created", nil, nil},
+		"relname":            {LABEL, "Name of the table on which the index is being created", nil, nil},
+		"index_relid":        {DISCARD, "OID of the index being created or reindexed", nil, nil},
+		"command":            {LABEL, "The command that is running", nil, nil},
+		"phase":              {LABEL, "Current processing phase of index creation", nil, nil},
+		"lockers_total":      {GAUGE, "Total number of lockers to wait for, when applicable", nil, nil},
+		"lockers_done":       {GAUGE, "Number of lockers already waited for", nil, nil},
+		"current_locker_pid": {DISCARD, "Process ID of the locker currently being waited for", nil, nil},
+		"blocks_total":       {GAUGE, "Total number of blocks to be processed in the current phase", nil, nil},
+		"blocks_done":        {GAUGE, "Number of blocks already processed in the current phase", nil, nil},
+		"tuples_total":       {GAUGE, "Total number of tuples to be processed in the current phase", nil, nil},
+		"tuples_done":        {GAUGE, "Number of tuples already processed in the current phase", nil, nil},
+		"partitions_total":   {GAUGE, "Total number of partitions on which the index is to be created or attached", nil, nil},
+		"partitions_done":    {GAUGE, "Number of partitions on which the index has been created or attached", nil, nil},
+		"progress_ratio":     {GAUGE, "Fraction of the blocks, or failing that tuples, processed in the current phase (0-1)", nil, nil},
+	},
+	"pg_stat_progress_cluster": {
+		"pid":                 {LABEL, "Process ID of backend", nil, nil},
+		"datid":               {DISCARD, "OID of the database to which this backend is connected", nil, nil},
+		"datname":             {LABEL, "Name of the database to which this backend is connected", nil, nil},
+		"relid":               {DISCARD, "OID of the table being clustered", nil, nil},
+		"relname":             {LABEL, "Name of the table being clustered", nil, nil},
+		"command":             {LABEL, "The command that is running. Either CLUSTER or VACUUM FULL", nil, nil},
+		"phase":               {LABEL, "Current processing phase", nil, nil},
+		"cluster_index_relid": {DISCARD, "If the table is being scanned using an index, this is the OID of the index being used", nil, nil},
+		"heap_tuples_scanned": {GAUGE, "Number of heap tuples scanned", nil, nil},
+		"heap_tuples_written": {GAUGE, "Number of heap tuples written", nil, nil},
+		"heap_blks_total":     {GAUGE, "Total number of heap blocks in the table", nil, nil},
+		"heap_blks_scanned":   {GAUGE, "Number of heap blocks scanned", nil, nil},
+		"index_rebuild_count": {GAUGE, "Number of indexes rebuilt", nil, nil},
+		"progress_ratio":      {GAUGE, "Fraction of the heap blocks scanned (0-1)", nil, nil},
+	},
+	"pg_stat_progress_analyze": {
+		"pid":                       {LABEL, "Process ID of backend", nil, nil},
+		"datid":                     {DISCARD, "OID of the database to which this backend is connected", nil, nil},
+		"datname":                   {LABEL, "Name of the database to which this backend is connected", nil, nil},
+		"relid":                     {DISCARD, "OID of the table being analyzed", nil, nil},
+		"relname":                   {LABEL, "Name of the table being analyzed", nil, nil},
+		"phase":                     {LABEL, "Current processing phase", nil, nil},
+		"sample_blks_total":         {GAUGE, "Total number of heap blocks that will be sampled", nil, nil},
+		"sample_blks_scanned":       {GAUGE, "Number of heap blocks scanned", nil, nil},
+		"ext_stats_total":           {GAUGE, "Number of extended statistics", nil, nil},
+		"ext_stats_computed":        {GAUGE, "Number of extended statistics computed", nil, nil},
+		"child_tables_total":        {GAUGE, "Number of child tables", nil, nil},
+		"child_tables_done":         {GAUGE, "Number of child tables scanned", nil, nil},
+		"current_child_table_relid": {DISCARD, "OID of the child table currently being scanned", nil, nil},
+		"delay_time":                {GAUGE, "Total time spent sleeping due to cost-based delay, in milliseconds", nil, semver.MustParseRange(">=18.0.0")},
+		"progress_ratio":            {GAUGE, "Fraction of the sample blocks scanned (0-1)", nil, nil},
+	},
+	"pg_stat_progress_basebackup": {
+		"pid":                  {LABEL, "Process ID of a WAL sender process", nil, nil},
+		"phase":                {LABEL, "Current processing phase", nil, nil},
+		"backup_total":         {GAUGE, "Total amount of data that will be streamed, in bytes", nil, nil},
+		"backup_streamed":      {GAUGE, "Amount of data streamed, in bytes", nil, nil},
+		"tablespaces_total":    {GAUGE, "Total number of tablespaces that will be streamed", nil, nil},
+		"tablespaces_streamed": {GAUGE, "Number of tablespaces streamed", nil, nil},
+		"progress_ratio":       {GAUGE, "Fraction of the estimated backup size streamed (0-1)", nil, nil},
+	},
+	"pg_stat_progress_copy": {
+		"pid":              {LABEL, "Process ID of backend", nil, nil},
+		"datid":            {DISCARD, "OID of the database to which this backend is connected", nil, nil},
+		"datname":          {LABEL, "Name of the database to which this backend is connected", nil, nil},
+		"relid":            {DISCARD, "OID of the table on which the COPY command is executed", nil, nil},
+		"relname":          {LABEL, "Name of the table on which the COPY command is executed", nil, nil},
+		"command":          {LABEL, "The command that is running: COPY FROM, or COPY TO", nil, nil},
+		"type":             {LABEL, "The io type that the data is read from or written to: FILE, PROGRAM, PIPE or CALLBACK", nil, nil},
+		"bytes_processed":  {GAUGE, "Number of bytes already processed by COPY command", nil, nil},
+		"bytes_total":      {GAUGE, "Size of source file for COPY FROM command in bytes, or 0 if not available", nil, nil},
+		"tuples_processed": {GAUGE, "Number of tuples already processed by COPY command", nil, nil},
+		"tuples_excluded":  {GAUGE, "Number of tuples not processed because they were excluded by the WHERE clause of the COPY command", nil, nil},
+		"tuples_skipped":   {GAUGE, "Number of tuples skipped because they contain malformed data", nil, semver.MustParseRange(">=17.0.0")},
+		"progress_ratio":   {GAUGE, "Fraction of the source file processed by COPY FROM (0-1)", nil, nil},
+	},
+	"pg_table_size": {
+		"datname":       {LABEL, "Name of the database this table is in", nil, nil},
+		"schemaname":    {LABEL, "Name of the schema this table is in", nil, nil},
+		"relname":       {LABEL, "Name of this table", nil, nil},
+		"table_bytes":   {GAUGE, "Disk space used by the main fork of this table, in bytes", nil, nil},
+		"indexes_bytes": {GAUGE, "Disk space used by the indexes attached to this table, in bytes", nil, nil},
+		"toast_bytes":   {GAUGE, "Disk space used by the TOAST table and its index, in bytes", nil, nil},
+		"total_bytes":   {GAUGE, "Total disk space used by this table, including indexes and TOAST data, in bytes", nil, nil},
+	},
+	"pg_table_bloat": {
+		"datname":     {LABEL, "Name of the database this table is in", nil, nil},
+		"schemaname":  {LABEL, "Name of the schema this table is in", nil, nil},
+		"relname":     {LABEL, "Name of this table", nil, nil},
+		"real_bytes":  {GAUGE, "Disk space used by this table and its TOAST data, in bytes", nil, nil},
+		"bloat_bytes": {GAUGE, "Estimated disk space beyond what this table would need when freshly packed at its fillfactor, in bytes", nil, nil},
+		"bloat_ratio": {GAUGE, "Estimated fraction of this table which is bloat (0-1)", nil, nil},
+	},
+	"pg_index_unused": {
+		"datname":      {LABEL, "Name of the database this index is in", nil, nil},
+		"schemaname":   {LABEL, "Name of the schema this index is in", nil, nil},
+		"relname":      {LABEL, "Name of the table for this index", nil, nil},
+		"indexrelname": {LABEL, "Name of this index", nil, nil},
+		"size_bytes":   {GAUGE, "Disk space used by this index, which has never been scanned since the statistics were last reset, in bytes", nil, nil},
+	},
+	"pg_buffercache_summary": {
+		"buffers_used":   {GAUGE, "Number of shared buffers holding a page", nil, nil},
+		"buffers_unused": {GAUGE, "Number of shared buffers not in use", nil, nil},
+		"buffers_dirty":  {GAUGE, "Number of shared buffers holding a modified page not yet written to disk", nil, nil},
+	},
+	"pg_buffercache_database": {
+		"datname":       {LABEL, "Name of the database, global for shared catalogs", nil, nil},
+		"buffers":       {GAUGE, "Number of shared buffers holding pages of this database", nil, nil},
+		"dirty_buffers": {GAUGE, "Number of shared buffers holding modified pages of this database", nil, nil},
+	},
+	"pg_buffercache_usage_count": {
+		"datname":    {LABEL, "Name of the database, global for shared catalogs", nil, nil},
+		"usagecount": {LABEL, "Clock-sweep access count of the buffers (0-5)", nil, nil},
+		"buffers":    {GAUGE, "Number of shared buffers of this database with this usage count", nil, nil},
+	},
+	"pg_buffercache_relation": {
+		"datname":         {LABEL, "Name of the database this relation is in", nil, nil},
+		"schemaname":      {LABEL, "Name of the schema this relation is in", nil, nil},
+		"relname":         {LABEL, "Name of the relation", nil, nil},
+		"buffers":         {GAUGE, "Number of shared buffers holding pages of this relation", nil, nil},
+		"dirty_buffers":   {GAUGE, "Number of shared buffers holding modified pages of this relation", nil, nil},
+		"usage_count_avg": {GAUGE, "Average clock-sweep access count of the buffers of this relation", nil, nil},
+	},
+	"pg_sequence_usage": {
+		"datname":      {LABEL, "Name of the database this sequence is in", nil, nil},
+		"schemaname":   {LABEL, "Name of the schema this sequence is in", nil, nil},
+		"sequencename": {LABEL, "Name of this sequence", nil, nil},
+		"last_value":   {GAUGE, "The last sequence value written to disk, NaN if the sequence has not been read from yet", nil, nil},
+		"max_value":    {GAUGE, "Maximum value of the sequence, or minimum value for a descending sequence", nil, nil},
+		"used_ratio":   {GAUGE, "Fraction of the range of the sequence which has been used up (0-1)", nil, nil},
+	},
+	"pg_stat_subscription": {
+		"subname":                      {LABEL, "Name of the subscription", nil, nil},
+		"worker_type":                  {LABEL, "Type of the subscription worker: apply or table synchronization", nil, nil},
+		"relname":                      {LABEL, "Name of the relation being synchronized, empty for the main apply worker", nil, nil},
+		"active":                       {GAUGE, "Whether the worker is running (1 for yes, 0 for no)", nil, nil},
+		"received_lsn":                 {COUNTER, "Last write-ahead log location received, as a byte offset", nil, nil},
+		"latest_end_lsn":               {COUNTER, "Last write-ahead log location reported to the origin WAL sender, as a byte offset", nil, nil},
+		"apply_lag_bytes":              {GAUGE, "Write-ahead log received but not yet reported back to the origin WAL sender, in bytes", nil, nil},
+		"apply_lag_seconds":            {GAUGE, "Seconds since the last write-ahead log location was reported to the origin WAL sender", nil, nil},
+		"last_msg_receipt_age_seconds": {GAUGE, "Seconds since the last message was received from the origin WAL sender", nil, nil},
+	},
+	"pg_subscription_rel": {
+		"subname": {LABEL, "Name of the subscription", nil, nil},
+		"relname": {LABEL, "Name of the relation", nil, nil},
+		"state": {MAPPEDMETRIC, "Synchronization state of the relation: 1 initialize, 2 data is being copied, 3 finished table copy, 4 synchronized, 5 ready", map[string]float64{
+			"i": 1,
+			"d": 2,
+			"f": 3,
+			"s": 4,
+			"r": 5,
+		}, nil},
+	},
+	"pg_stat_subscription_stats": {
+		"subid":                           {DISCARD, "OID of the subscription", nil, nil},
+		"subname":                         {LABEL, "Name of the subscription", nil, nil},
+		"apply_error_count":               {COUNTER, "Number of times an error occurred while applying changes", nil, nil},
+		"sync_error_count":                {COUNTER, "Number of times an error occurred during the initial table synchronization", nil, nil},
+		"confl_insert_exists":             {COUNTER, "Number of times a row insertion violated a NOT DEFERRABLE unique constraint while applying changes", nil, semver.MustParseRange(">=18.0.0")},
+		"confl_update_origin_differs":     {COUNTER, "Number of times an update was applied to a row that had been previously modified by another source", nil, semver.MustParseRange(">=18.0.0")},
+		"confl_update_exists":             {COUNTER, "Number of times that an updated row value violated a NOT DEFERRABLE unique constraint while applying changes", nil, semver.MustParseRange(">=18.0.0")},
+		"confl_update_missing":            {COUNTER, "Number of times the tuple to be updated was not found while applying changes", nil, semver.MustParseRange(">=18.0.0")},
+		"confl_delete_origin_differs":     {COUNTER, "Number of times a delete operation was applied to row that had been previously modified by another source", nil, semver.MustParseRange(">=18.0.0")},
+		"confl_delete_missing":            {COUNTER, "Number of times the tuple to be deleted was not found while applying changes", nil, semver.MustParseRange(">=18.0.0")},
+		"confl_multiple_unique_conflicts": {COUNTER, "Number of times a row insertion or an updated row values violated multiple NOT DEFERRABLE unique constraints while applying changes", nil, semver.MustParseRange(">=18.0.0")},
+		"stats_reset":                     {COUNTER, "Time at which these statistics were last reset", nil, nil},
+	},
+	"pg_publication": {
+		"datname":    {LABEL, "Name of the database this publication is in", nil, nil},
+		"pubname":    {LABEL, "Name of the publication", nil, nil},
+		"all_tables": {GAUGE, "Whether the publication automatically includes all tables in the database (1 for yes, 0 for no)", nil, nil},
+		"tables":     {GAUGE, "Number of tables published", nil, nil},
+	},
+	"pg_replication_slots_logical": {
+		"slot_name":                 {LABEL, "A unique, cluster-wide identifier for the replication slot", nil, nil},
+		"datname":                   {LABEL, "The name of the database this slot is associated with", nil, nil},
+		"plugin":                    {LABEL, "The base name of the shared object containing the output plugin this logical slot is using", nil, nil},
+		"active":                    {GAUGE, "Whether this slot is currently actively being used (1 for yes, 0 for no)", nil, nil},
+		"confirmed_flush_lag_bytes": {GAUGE, "Write-ahead log the consumer of this slot has not yet confirmed receiving, in bytes", nil, nil},
+	},
+	"pg_edb_system_waits": {
+		"datname":         {LABEL, "Name of the database the snapshot was taken in", nil, nil},
+		"wait_name":       {LABEL, "Name of the wait event", nil, nil},
+		"wait_count":      {COUNTER, "Number of times the wait event occurred, as of the latest DRITA snapshot", nil, nil},
+		"total_wait_time": {COUNTER, "Total time spent waiting on the event, as of the latest DRITA snapshot", nil, nil},
+	},
+	"pg_edb_audit_settings": {
+		"name":    {LABEL, "Name of the EDB audit setting", nil, nil},
+		"setting": {LABEL, "Current value of the EDB audit setting", nil, nil},
+		"info":    {GAUGE, "EDB audit settings, always 1", nil, nil},
+	},
+}
+
+// dsnKind is a set of the ways a DSN is scraped.
+type dsnKind int
+
+const (
+	// The DSN of a configured target
+	dsnTarget dsnKind = 1 << iota
+	// The DSN of a database found by --auto-discover-databases, which is also
+	// that of the target when the target already names the database
+	dsnDiscoveredDatabase
+)
+
+// namespaceRequirement restricts a builtin namespace to the servers able to
+// answer it, beyond what the version ranges of its queries express.
+type namespaceRequirement struct {
+	flavour   string                // Only query servers of this flavour, any flavour if empty
+	relations []string              // Relations which have to exist, see capabilities
+	extension *extensionRequirement // Extension which has to be installed, if any
+	dsns      dsnKind               // Only query DSNs of one of these kinds, any DSN if 0
+}
+
+var namespaceRequirements = map[string]namespaceRequirement{
+	"pg_stat_io":                    {relations: []string{"pg_stat_io"}},
+	"pg_stat_wal":                   {relations: []string{"pg_stat_wal"}},
+	"pg_stat_progress_vacuum":       {relations: []string{"pg_stat_progress_vacuum"}},
+	"pg_stat_progress_create_index": {relations: []string{"pg_stat_progress_create_index"}},
+	"pg_stat_progress_cluster":      {relations: []string{"pg_stat_progress_cluster"}},
+	"pg_stat_progress_analyze":      {relations: []string{"pg_stat_progress_analyze"}},
+	"pg_stat_progress_basebackup":   {relations: []string{"pg_stat_progress_basebackup"}},
+	"pg_stat_progress_copy":         {relations: []string{"pg_stat_progress_copy"}},
+	"pg_stat_subscription":          {relations: []string{"pg_stat_subscription", "pg_subscription"}},
+	"pg_subscription_rel":           {relations: []string{"pg_subscription_rel", "pg_subscription"}},
+	"pg_stat_subscription_stats":    {relations: []string{"pg_stat_subscription_stats"}},
+	"pg_publication":                {relations: []string{"pg_publication", "pg_publication_tables"}},
+	"pg_buffercache_summary":        {extension: mustParseExtensionRequirement("pg_buffercache"), dsns: dsnTarget},
+	"pg_buffercache_database":       {extension: mustParseExtensionRequirement("pg_buffercache"), dsns: dsnTarget},
+	"pg_buffercache_usage_count":    {extension: mustParseExtensionRequirement("pg_buffercache"), dsns: dsnTarget},
+	"pg_buffercache_relation":       {extension: mustParseExtensionRequirement("pg_buffercache")},
+	"pg_edb_system_waits":           {flavour: flavourEPAS, relations: []string{"edb$system_waits", "edb$snap"}},
+	"pg_edb_audit_settings":         {flavour: flavourEPAS},
+	"pg_sequence_usage":             {dsns: dsnDiscoveredDatabase},
+}
+
+// Explain why a server of the given flavour and capabilities does not meet
+// the requirement, or return an empty string if it does. Relations are not
+// checked if the capabilities are unknown.
+func (r namespaceRequirement) unmetBy(flavour string, caps *capabilities) string {
+	if r.flavour != "" && r.flavour != flavour {
+		return fmt.Sprintf("it is specific to %s", r.flavour)
+	}
+	if caps == nil {
+		return ""
+	}
+	for _, relation := range r.relations {
+		if !caps.hasRelation(relation) {
+			return fmt.Sprintf("relation %s does not exist", relation)
+		}
+	}
+	if r.extension != nil && !caps.hasExtension(r.extension) {
+		return fmt.Sprintf("extension %s is not installed", r.extension)
+	}
+	return ""
+}
+
+// Whether the namespace is queried on a DSN of the given kinds. Unlike the
+// other requirements this depends on how the server is scraped rather than on
+// the server, so it is checked on every scrape.
+func (r namespaceRequirement) queriedOn(kinds dsnKind) bool {
+	return r.dsns == 0 || r.dsns&kinds != 0
+}
+
+// Namespaces which are only queried when their collector is enabled, see
+// Exporter.disabledNamespaces.
+var bufferCacheNamespaces = []string{
+	"pg_buffercache_summary",
+	"pg_buffercache_database",
+	"pg_buffercache_usage_count",
+	"pg_buffercache_relation",
+}
+
+// Remove the namespaces whose requirements the server does not meet from its
+// metric map and query overrides.
+func removeUnsupportedNamespaces(flavour string, caps *capabilities, metricMap map[string]MetricMapNamespace, queryOverrides map[string]string) {
+	for namespace, requirement := range namespaceRequirements {
+		if reason := requirement.unmetBy(flavour, caps); reason != "" {
+			log.Debugln(namespace, "is being removed as", reason)
+			delete(metricMap, namespace)
+			delete(queryOverrides, namespace)
+		}
+	}
 }
 
 // MakeDescMap Abstracting the private function for now
@@ -167,6 +517,9 @@ func makeDescMap(pgVersion semver.Version, serverLabels prometheus.Labels, metri
 		}
 
 		for columnName, columnMapping := range mappings {
+			// The conversion closures below outlive this iteration.
+			columnName, columnMapping := columnName, columnMapping
+
 			// Check column version compatibility for the current map
 			// Force to discard if not compatible.
 			if columnMapping.supportedVersions != nil {
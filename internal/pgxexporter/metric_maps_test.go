@@ -0,0 +1,215 @@
+// +build !integration
+
+package pgxexporter
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/prometheus/client_golang/prometheus"
+	. "gopkg.in/check.v1"
+)
+
+type MetricMapsSuite struct{}
+
+var _ = Suite(&MetricMapsSuite{})
+
+// Matches a query selecting every column of a view, e.g. SELECT p.*
+var selectsAllRegex = regexp.MustCompile(`[\s.]\*[\s,]`)
+
+// Check that a builtin namespace goes through makeDescMap and
+// makeQueryOverrideMap for the version: every column the version supports is
+// mapped and, unless it selects every column of a view, selected by the
+// override query.
+func checkBuiltinNamespace(c *C, version string, namespace string) {
+	v := semver.MustParse(version)
+	comment := Commentf("%s on %s", namespace, version)
+
+	mapping, ok := makeDescMap(v, prometheus.Labels{"server": "test"}, builtinMetricMaps)[namespace]
+	c.Assert(ok, Equals, true, comment)
+	query := makeQueryOverrideMap(v, queryOverrides)[namespace]
+	c.Assert(query, Not(Equals), "", comment)
+
+	selectsAll := selectsAllRegex.MatchString(query)
+
+	var labels []string
+	for column, columnMapping := range builtinMetricMaps[namespace] {
+		metricMap, ok := mapping.columnMappings[column]
+		c.Assert(ok, Equals, true, Commentf("%s.%s on %s", namespace, column, version))
+		if columnMapping.supportedVersions != nil && !columnMapping.supportedVersions(v) {
+			c.Check(metricMap.discard, Equals, true, Commentf("%s.%s on %s", namespace, column, version))
+			continue
+		}
+
+		switch columnMapping.usage {
+		case DISCARD:
+			continue
+		case LABEL:
+			labels = append(labels, column)
+		default:
+			c.Check(metricMap.discard, Equals, false, Commentf("%s.%s on %s", namespace, column, version))
+			c.Check(metricMap.desc, NotNil, Commentf("%s.%s on %s", namespace, column, version))
+		}
+		if selectsAll {
+			continue
+		}
+		c.Check(strings.Contains(query, column), Equals, true, Commentf("%s.%s is not selected on %s", namespace, column, version))
+	}
+
+	sort.Strings(labels)
+	mappedLabels := append([]string(nil), mapping.labels...)
+	sort.Strings(mappedLabels)
+	c.Check(mappedLabels, DeepEquals, labels, comment)
+}
+
+// Check that a builtin namespace has no query for the version, which disables
+// it.
+func checkBuiltinNamespaceDisabled(c *C, version string, namespace string) {
+	query, ok := makeQueryOverrideMap(semver.MustParse(version), queryOverrides)[namespace]
+	c.Check(ok, Equals, true, Commentf("%s on %s", namespace, version))
+	c.Check(query, Equals, "", Commentf("%s on %s", namespace, version))
+}
+
+func (s *MetricMapsSuite) TestProgressNamespaces(c *C) {
+	namespaces := map[string]string{
+		"pg_stat_progress_vacuum":       "9.6.0",
+		"pg_stat_progress_create_index": "12.0.0",
+		"pg_stat_progress_cluster":      "12.0.0",
+		"pg_stat_progress_analyze":      "13.0.0",
+		"pg_stat_progress_basebackup":   "13.0.0",
+		"pg_stat_progress_copy":         "14.0.0",
+	}
+	for namespace, since := range namespaces {
+		checkBuiltinNamespace(c, since, namespace)
+		checkBuiltinNamespace(c, "18.0.0", namespace)
+	}
+
+	checkBuiltinNamespaceDisabled(c, "9.5.0", "pg_stat_progress_vacuum")
+	checkBuiltinNamespaceDisabled(c, "11.0.0", "pg_stat_progress_cluster")
+	checkBuiltinNamespaceDisabled(c, "13.0.0", "pg_stat_progress_copy")
+}
+
+func (s *MetricMapsSuite) TestRelationNamespaces(c *C) {
+	for _, namespace := range []string{"pg_table_size", "pg_table_bloat", "pg_index_unused"} {
+		checkBuiltinNamespace(c, "9.0.0", namespace)
+		checkBuiltinNamespace(c, "18.0.0", namespace)
+
+		query := makeQueryOverrideMap(semver.MustParse("18.0.0"), queryOverrides)[namespace]
+		c.Check(strings.Contains(query, "$1::bigint"), Equals, true, Commentf(namespace))
+		c.Check(strings.Contains(query, "LIMIT $2::bigint"), Equals, true, Commentf(namespace))
+	}
+
+	e := &Exporter{relationSizeThreshold: 1 << 20}
+	c.Check(e.makeQueryArgs()["pg_table_size"], DeepEquals, []interface{}{int64(1 << 20), nil})
+
+	e.relationTopN = 10
+	c.Check(e.makeQueryArgs()["pg_table_bloat"], DeepEquals, []interface{}{int64(1 << 20), int64(10)})
+	c.Check(e.makeQueryArgs()["pg_index_unused"], DeepEquals, []interface{}{int64(1 << 20), int64(10)})
+}
+
+func (s *MetricMapsSuite) TestSequenceNamespace(c *C) {
+	// pg_sequences on PostgreSQL 10 and later, reading every sequence before.
+	checkBuiltinNamespace(c, "9.1.0", "pg_sequence_usage")
+	checkBuiltinNamespace(c, "10.0.0", "pg_sequence_usage")
+	checkBuiltinNamespaceDisabled(c, "9.0.0", "pg_sequence_usage")
+
+	v10 := makeQueryOverrideMap(semver.MustParse("10.0.0"), queryOverrides)["pg_sequence_usage"]
+	v96 := makeQueryOverrideMap(semver.MustParse("9.6.0"), queryOverrides)["pg_sequence_usage"]
+	c.Check(strings.Contains(v10, "FROM pg_sequences"), Equals, true)
+	c.Check(strings.Contains(v96, "FROM pg_sequences"), Equals, false)
+}
+
+func (s *MetricMapsSuite) TestSequenceNamespaceOnDiscoveredDatabases(c *C) {
+	requirement := namespaceRequirements["pg_sequence_usage"]
+	c.Check(requirement.queriedOn(dsnTarget), Equals, false)
+	c.Check(requirement.queriedOn(dsnDiscoveredDatabase), Equals, true)
+	c.Check(requirement.queriedOn(dsnTarget|dsnDiscoveredDatabase), Equals, true)
+
+	c.Check(namespaceRequirements["pg_table_size"].queriedOn(dsnTarget), Equals, true)
+	c.Check(namespaceRequirements["pg_table_size"].queriedOn(dsnDiscoveredDatabase), Equals, true)
+}
+
+func (s *MetricMapsSuite) TestActivityDetailNamespace(c *C) {
+	checkBuiltinNamespace(c, "9.2.0", "pg_stat_activity_detail")
+	checkBuiltinNamespace(c, "9.6.0", "pg_stat_activity_detail")
+	checkBuiltinNamespace(c, "18.0.0", "pg_stat_activity_detail")
+	checkBuiltinNamespaceDisabled(c, "9.1.0", "pg_stat_activity_detail")
+
+	e := &Exporter{idleInTransactionThreshold: 90 * time.Second}
+	c.Check(e.makeQueryArgs()["pg_stat_activity_detail"], DeepEquals, []interface{}{float64(90)})
+}
+
+func (s *MetricMapsSuite) TestLogicalReplicationNamespaces(c *C) {
+	namespaces := map[string]string{
+		"pg_stat_subscription":         "10.0.0",
+		"pg_subscription_rel":          "10.0.0",
+		"pg_stat_subscription_stats":   "15.0.0",
+		"pg_publication":               "10.0.0",
+		"pg_replication_slots_logical": "10.0.0",
+	}
+	for namespace, since := range namespaces {
+		checkBuiltinNamespace(c, since, namespace)
+		checkBuiltinNamespace(c, "18.0.0", namespace)
+		checkBuiltinNamespaceDisabled(c, "9.6.0", namespace)
+	}
+
+	// Parallel apply workers are only reported from PostgreSQL 16 on.
+	checkBuiltinNamespace(c, "16.0.0", "pg_stat_subscription")
+	checkBuiltinNamespaceDisabled(c, "14.0.0", "pg_stat_subscription_stats")
+}
+
+func (s *MetricMapsSuite) TestCheckpointerSplit(c *C) {
+	// pg_stat_checkpointer columns are mapped back to their pg_stat_bgwriter
+	// names from PostgreSQL 17 on.
+	checkBuiltinNamespace(c, "16.0.0", "pg_stat_bgwriter")
+	checkBuiltinNamespace(c, "17.0.0", "pg_stat_bgwriter")
+
+	v16 := makeDescMap(semver.MustParse("16.0.0"), prometheus.Labels{}, builtinMetricMaps)["pg_stat_bgwriter"]
+	v17 := makeDescMap(semver.MustParse("17.0.0"), prometheus.Labels{}, builtinMetricMaps)["pg_stat_bgwriter"]
+	c.Check(v16.columnMappings["restartpoints_done"].discard, Equals, true)
+	c.Check(v17.columnMappings["restartpoints_done"].discard, Equals, false)
+	c.Check(v16.columnMappings["buffers_checkpoint"].desc.String(), Equals, v17.columnMappings["buffers_checkpoint"].desc.String())
+
+	checkBuiltinNamespace(c, "16.0.0", "pg_stat_io")
+	checkBuiltinNamespaceDisabled(c, "15.0.0", "pg_stat_io")
+}
+
+func (s *MetricMapsSuite) TestEPASNamespaces(c *C) {
+	for _, namespace := range []string{"pg_edb_system_waits", "pg_edb_audit_settings"} {
+		checkBuiltinNamespace(c, "9.6.0", namespace)
+		checkBuiltinNamespace(c, "16.0.0", namespace)
+
+		for flavour, kept := range map[string]bool{flavourPostgreSQL: false, flavourEPAS: true} {
+			v := semver.MustParse("16.0.0")
+			metricMap := makeDescMap(v, prometheus.Labels{}, builtinMetricMaps)
+			overrides := makeQueryOverrideMap(v, queryOverrides)
+			removeUnsupportedNamespaces(flavour, nil, metricMap, overrides)
+
+			_, ok := metricMap[namespace]
+			c.Check(ok, Equals, kept, Commentf("%s on %s", namespace, flavour))
+			_, ok = overrides[namespace]
+			c.Check(ok, Equals, kept, Commentf("%s on %s", namespace, flavour))
+		}
+	}
+}
+
+func (s *MetricMapsSuite) TestClusterBufferCacheNamespacesOnTargets(c *C) {
+	for _, namespace := range []string{"pg_buffercache_summary", "pg_buffercache_database", "pg_buffercache_usage_count"} {
+		c.Check(namespaceRequirements[namespace].queriedOn(dsnTarget), Equals, true, Commentf(namespace))
+		c.Check(namespaceRequirements[namespace].queriedOn(dsnTarget|dsnDiscoveredDatabase), Equals, true, Commentf(namespace))
+		c.Check(namespaceRequirements[namespace].queriedOn(dsnDiscoveredDatabase), Equals, false, Commentf(namespace))
+	}
+	c.Check(namespaceRequirements["pg_buffercache_relation"].queriedOn(dsnDiscoveredDatabase), Equals, true)
+}
+
+func (s *MetricMapsSuite) TestBufferCacheRelationLimit(c *C) {
+	e := &Exporter{relationTopN: 10}
+	c.Check(e.makeQueryArgs()["pg_buffercache_relation"], DeepEquals, []interface{}{nil})
+
+	e.bufferCacheRelationTopN = 20
+	c.Check(e.makeQueryArgs()["pg_buffercache_relation"], DeepEquals, []interface{}{int64(20)})
+	c.Check(e.makeQueryArgs()["pg_table_size"], DeepEquals, []interface{}{int64(0), int64(10)})
+}
@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/blang/semver"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 )
@@ -18,7 +19,7 @@ func QuerySettings(ch chan<- prometheus.Metric, server *Server) error {
 // Query the pg_settings view containing runtime variables
 func querySettings(ch chan<- prometheus.Metric, server *Server) error {
 	log.Debugf("Querying pg_setting view on %q", server)
-	conn, err := server.db.Acquire(context.Background())
+	conn, err := server.acquire(context.Background())
 	if err != nil {
 		log.Errorf("unable to acquire db connect: %v", err)
 		return err
@@ -29,7 +30,12 @@ func querySettings(ch chan<- prometheus.Metric, server *Server) error {
 	//
 	// NOTE: If you add more vartypes here, you must update the supported
 	// types in normaliseUnit() below
-	query := "SELECT name, setting, COALESCE(unit, ''), short_desc, vartype FROM pg_settings WHERE vartype IN ('bool', 'integer', 'real');"
+	pendingRestart := "pending_restart"
+	if server.lastMapVersion.LT(semver.MustParse("9.5.0")) {
+		pendingRestart = "false"
+	}
+	query := `SELECT name, setting, COALESCE(unit, ''), short_desc, vartype, source, COALESCE(sourcefile, ''),
+		` + pendingRestart + `, setting IS DISTINCT FROM boot_val FROM pg_settings;`
 
 	rows, err := conn.Conn().Query(context.Background(), query)
 	if err != nil {
@@ -37,27 +43,98 @@ func querySettings(ch chan<- prometheus.Metric, server *Server) error {
 	}
 	defer rows.Close() // nolint: errcheck
 
+	infoAllowed := make(map[string]bool)
+	for _, name := range server.settings.infoAllowlist {
+		infoAllowed[name] = true
+	}
+	var nonDefault int
+
 	for rows.Next() {
 		s := &pgSetting{}
-		err = rows.Scan(&s.name, &s.setting, &s.unit, &s.shortDesc, &s.vartype)
+		err = rows.Scan(&s.name, &s.setting, &s.unit, &s.shortDesc, &s.vartype, &s.source, &s.sourcefile, &s.pendingRestart, &s.nonDefault)
 		if err != nil {
 			log.Debugf("unable to scan row for pg settings on %v", server)
 			return fmt.Errorf("Error retrieving rows on %q: %s %v", server, namespace, err)
 		}
 
-		ch <- s.metric(server.labels)
+		// Settings of the exporter's own session say nothing about the server.
+		if s.nonDefault && s.source != "client" && s.source != "session" {
+			nonDefault++
+		}
+		if !server.settings.filter.match(s.name) {
+			continue
+		}
+		ch <- s.pendingRestartMetric(server.labels, server.settings.sourceLabels)
+
+		switch s.vartype {
+		case "bool", "integer", "real":
+			m, err := s.metric(server.labels)
+			if err != nil {
+				log.Warnf("Skipping setting %s on %q: %v", s.name, server, err)
+				continue
+			}
+			if s.unknownUnit() && server.settings.unknownUnits != nil {
+				server.settings.unknownUnits.Inc()
+			}
+			ch <- m
+		case "string", "enum":
+			if infoAllowed[s.name] {
+				ch <- s.infoMetric(server.labels)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Error retrieving rows on %q: %s %v", server, namespace, err)
 	}
 
+	desc := newDesc("settings", "non_default_count", "Number of settings whose value differs from their compiled-in default, not counting those set by the client.", server.labels)
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(nonDefault))
+
 	return nil
 }
 
 // pgSetting is represents a PostgreSQL runtime variable as returned by the
 // pg_settings view.
 type pgSetting struct {
-	name, setting, unit, shortDesc, vartype string
+	name, setting, unit, shortDesc, vartype, source, sourcefile string
+	pendingRestart, nonDefault                                  bool
 }
 
-func (s *pgSetting) metric(labels prometheus.Labels) prometheus.Metric {
+// Export whether the setting was changed in the configuration files but
+// requires a restart to take effect, optionally labelled by where it was set.
+func (s *pgSetting) pendingRestartMetric(labels prometheus.Labels, sourceLabels bool) prometheus.Metric {
+	labelNames := []string{"name"}
+	labelValues := []string{s.name}
+	if sourceLabels {
+		labelNames = append(labelNames, "source", "sourcefile")
+		labelValues = append(labelValues, s.source, s.sourcefile)
+	}
+
+	desc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "settings", "pending_restart"),
+		"Whether the setting has been changed in the configuration files but requires a restart to take effect (1 for yes, 0 for no).",
+		labelNames, labels,
+	)
+
+	var val float64
+	if s.pendingRestart {
+		val = 1
+	}
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, val, labelValues...)
+}
+
+// Export a string or enum setting as an info metric carrying its value, as
+// its value cannot be converted to a float.
+func (s *pgSetting) infoMetric(labels prometheus.Labels) prometheus.Metric {
+	desc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "settings", "info"),
+		"Value of a string or enum runtime variable, as the value label.",
+		[]string{"name", "value", "source"}, labels,
+	)
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, s.name, s.setting, s.source)
+}
+
+func (s *pgSetting) metric(labels prometheus.Labels) (prometheus.Metric, error) {
 	var err error
 	var name = strings.Replace(s.name, ".", "_", -1)
 	var unit = s.unit // nolint: ineffassign
@@ -71,10 +148,19 @@ func (s *pgSetting) metric(labels prometheus.Labels) prometheus.Metric {
 			val = 1
 		}
 	case "integer", "real":
+		if s.unknownUnit() {
+			// Export the value as it is rather than dropping the setting, so
+			// a unit introduced by a new release does not go unnoticed.
+			if val, err = strconv.ParseFloat(s.setting, 64); err != nil {
+				return nil, fmt.Errorf("Error converting setting %q value %q to float: %s", s.name, s.setting, err)
+			}
+			shortDesc = fmt.Sprintf("%s [Unknown unit, not converted.]", shortDesc)
+			desc := prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), shortDesc, []string{"unit"}, labels)
+			return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, val, s.unit), nil
+		}
+
 		if val, unit, err = s.normaliseUnit(); err != nil {
-			// Panic, since we should recognise all units
-			// and don't want to silently exlude metrics
-			panic(err)
+			return nil, err
 		}
 
 		if len(unit) > 0 {
@@ -82,12 +168,27 @@ func (s *pgSetting) metric(labels prometheus.Labels) prometheus.Metric {
 			shortDesc = fmt.Sprintf("%s [Units converted to %s.]", shortDesc, unit)
 		}
 	default:
-		// Panic because we got a type we didn't ask for
-		panic(fmt.Sprintf("Unsupported vartype %q", s.vartype))
+		return nil, fmt.Errorf("Unsupported vartype %q", s.vartype)
 	}
 
 	desc := newDesc(subsystem, name, shortDesc, labels)
-	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, val)
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, val), nil
+}
+
+// unknownUnitError is returned by normaliseUnit for units it cannot convert.
+type unknownUnitError struct {
+	unit string
+}
+
+func (e *unknownUnitError) Error() string {
+	return fmt.Sprintf("Unknown unit for runtime variable: %q", e.unit)
+}
+
+// Report whether the setting has a unit normaliseUnit cannot convert.
+func (s *pgSetting) unknownUnit() bool {
+	_, _, err := s.normaliseUnit()
+	_, ok := err.(*unknownUnitError)
+	return ok
 }
 
 // TODO: fix linter override
@@ -107,7 +208,7 @@ func (s *pgSetting) normaliseUnit() (val float64, unit string, err error) {
 	case "B", "kB", "MB", "GB", "TB", "8kB", "16kB", "32kB", "16MB", "32MB", "64MB":
 		unit = "bytes"
 	default:
-		err = fmt.Errorf("Unknown unit for runtime variable: %q", s.unit)
+		err = &unknownUnitError{unit: s.unit}
 		return
 	}
 
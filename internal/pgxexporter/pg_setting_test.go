@@ -202,6 +202,8 @@ var fixtures = []fixture{
 			unit: "",
 			err:  `Unknown unit for runtime variable: "nonexistent"`,
 		},
+		d: `Desc{fqName: "pg_settings_unknown_unit", help: "foo foo foo [Unknown unit, not converted.]", constLabels: {}, variableLabels: [unit]}`,
+		v: 10,
 	},
 }
 
@@ -224,17 +226,10 @@ func (s *PgSettingSuite) TestNormaliseUnit(c *C) {
 }
 
 func (s *PgSettingSuite) TestMetric(c *C) {
-	defer func() {
-		if r := recover(); r != nil {
-			if r.(error).Error() != `Unknown unit for runtime variable: "nonexistent"` {
-				panic(r)
-			}
-		}
-	}()
-
 	for _, f := range fixtures {
 		d := &dto.Metric{}
-		m := f.p.metric(prometheus.Labels{})
+		m, err := f.p.metric(prometheus.Labels{})
+		c.Assert(err, IsNil)
 		m.Write(d) // nolint: errcheck
 
 		c.Check(m.Desc().String(), Equals, f.d)
@@ -242,6 +237,85 @@ func (s *PgSettingSuite) TestMetric(c *C) {
 	}
 }
 
+func (s *PgSettingSuite) TestUnknownUnit(c *C) {
+	for _, f := range fixtures {
+		c.Check(f.p.unknownUnit(), Equals, f.p.unit == "nonexistent", Commentf(f.p.name))
+	}
+
+	p := pgSetting{name: "unknown_unit", setting: "10", unit: "nonexistent", vartype: "integer"}
+	d := &dto.Metric{}
+	m, err := p.metric(prometheus.Labels{})
+	c.Assert(err, IsNil)
+	m.Write(d) // nolint: errcheck
+	c.Check(d.GetLabel(), HasLen, 1)
+	c.Check(d.GetLabel()[0].GetName(), Equals, "unit")
+	c.Check(d.GetLabel()[0].GetValue(), Equals, "nonexistent")
+
+	p = pgSetting{name: "unknown_unit", setting: "ten", unit: "nonexistent", vartype: "integer"}
+	_, err = p.metric(prometheus.Labels{})
+	c.Check(err, NotNil)
+}
+
+func (s *PgSettingSuite) TestUnsupportedVartype(c *C) {
+	p := pgSetting{name: "wal_level", setting: "replica", vartype: "enum"}
+	_, err := p.metric(prometheus.Labels{})
+	c.Check(err, ErrorMatches, `Unsupported vartype "enum"`)
+}
+
+func (s *PgSettingSuite) TestInfoMetric(c *C) {
+	p := pgSetting{
+		name:      "wal_level",
+		setting:   "replica",
+		shortDesc: "Sets the level of information written to the WAL.",
+		vartype:   "enum",
+		source:    "configuration file",
+	}
+
+	d := &dto.Metric{}
+	m := p.infoMetric(prometheus.Labels{})
+	m.Write(d) // nolint: errcheck
+
+	c.Check(m.Desc().String(), Equals, `Desc{fqName: "pg_settings_info", help: "Value of a string or enum runtime variable, as the value label.", constLabels: {}, variableLabels: [name value source]}`)
+	c.Check(d.GetGauge().GetValue(), Equals, 1.0)
+	c.Check(d.GetLabel(), HasLen, 3)
+	for _, l := range d.GetLabel() {
+		switch l.GetName() {
+		case "name":
+			c.Check(l.GetValue(), Equals, "wal_level")
+		case "value":
+			c.Check(l.GetValue(), Equals, "replica")
+		case "source":
+			c.Check(l.GetValue(), Equals, "configuration file")
+		}
+	}
+}
+
+func (s *PgSettingSuite) TestPendingRestartMetric(c *C) {
+	p := pgSetting{
+		name:           "shared_buffers",
+		setting:        "16384",
+		unit:           "8kB",
+		vartype:        "integer",
+		source:         "configuration file",
+		sourcefile:     "/etc/postgresql/postgresql.conf",
+		pendingRestart: true,
+	}
+
+	d := &dto.Metric{}
+	m := p.pendingRestartMetric(prometheus.Labels{}, false)
+	m.Write(d) // nolint: errcheck
+	c.Check(m.Desc().String(), Matches, `.*fqName: "pg_settings_pending_restart".*variableLabels: \[name\]}`)
+	c.Check(d.GetGauge().GetValue(), Equals, 1.0)
+
+	p.pendingRestart = false
+	d = &dto.Metric{}
+	m = p.pendingRestartMetric(prometheus.Labels{}, true)
+	m.Write(d) // nolint: errcheck
+	c.Check(m.Desc().String(), Matches, `.*variableLabels: \[name source sourcefile\]}`)
+	c.Check(d.GetGauge().GetValue(), Equals, 0.0)
+	c.Check(d.GetLabel(), HasLen, 3)
+}
+
 type normalised struct {
 	val  float64
 	unit string
@@ -6,6 +6,8 @@ import (
 	"github.com/blang/semver"
 	"github.com/prometheus/common/log"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
 // Metric name parts.
@@ -35,14 +37,51 @@ const (
 	DURATION     ColumnUsage = iota // This column should be interpreted as a text duration (and converted to milliseconds)
 )
 
+// Flavours of PostgreSQL told apart by the exporter, see parseFlavour.
+const (
+	flavourPostgreSQL = "postgresql"
+	flavourEPAS       = "epas" // EDB Postgres Advanced Server
+)
+
 // Regex used to get the "short-version" from the postgres version field.
 var versionRegex = regexp.MustCompile(`^\w+ ((\d+)(\.\d+)?(\.\d+)?)`)
+
+// Regex used to get the numeric part of server_version, which may be followed
+// by a pre-release tag or vendor suffix as in "16beta1" or "12.3 (Debian 12.3-1)".
+var serverVersionRegex = regexp.MustCompile(`^((\d+)(\.\d+)?(\.\d+)?)`)
 var lowestSupportedVersion = semver.MustParse("9.1.0")
 
 func ParseVersion(versionString string) (semver.Version, error) {
 	return parseVersion(versionString)
 }
 
+// Parses server_version_num, e.g. 90605 or 160001, into the semantic version
+// we match behaviours on. From PostgreSQL 10 on the number only encodes the
+// major and minor versions.
+func parseVersionNum(versionNum string) (semver.Version, error) {
+	n, err := strconv.ParseUint(strings.TrimSpace(versionNum), 10, 64)
+	if err != nil {
+		return semver.Version{}, fmt.Errorf("Could not parse server_version_num %q: %v", versionNum, err)
+	}
+	if n < 10000 {
+		return semver.Version{}, fmt.Errorf("Could not parse server_version_num %q: too small", versionNum)
+	}
+	if n >= 100000 {
+		return semver.Version{Major: n / 10000, Minor: n % 10000}, nil
+	}
+	return semver.Version{Major: n / 10000, Minor: n / 100 % 100, Patch: n % 100}, nil
+}
+
+// Parses server_version into the semantic version we match behaviours on,
+// ignoring anything after the numeric part.
+func parseServerVersion(serverVersion string) (semver.Version, error) {
+	submatches := serverVersionRegex.FindStringSubmatch(strings.TrimSpace(serverVersion))
+	if len(submatches) > 1 {
+		return semver.ParseTolerant(submatches[1])
+	}
+	return semver.Version{}, fmt.Errorf("Could not find a postgres version in server_version %q", serverVersion)
+}
+
 // Parses the version of postgres into the short version string we can use to
 // match behaviors.
 func parseVersion(versionString string) (semver.Version, error) {
@@ -54,3 +93,13 @@ func parseVersion(versionString string) (semver.Version, error) {
 	return semver.Version{},
 		errors.New(fmt.Sprintln("Could not find a postgres version in string:", versionString))
 }
+
+// Parses the flavour of postgres out of the version string. EDB Postgres
+// Advanced Server reports either "EnterpriseDB 9.6.5.10 on ..." or
+// "PostgreSQL 12.3 (EnterpriseDB Advanced Server 12.3.4) on ...".
+func parseFlavour(versionString string) string {
+	if strings.Contains(versionString, "EnterpriseDB") {
+		return flavourEPAS
+	}
+	return flavourPostgreSQL
+}
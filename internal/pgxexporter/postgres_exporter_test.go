@@ -0,0 +1,166 @@
+// +build !integration
+
+package pgxexporter
+
+import (
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/prometheus/client_golang/prometheus"
+	. "gopkg.in/check.v1"
+)
+
+type VersionSuite struct{}
+
+var _ = Suite(&VersionSuite{})
+
+func (s *VersionSuite) TestParseVersionNum(c *C) {
+	cases := map[string]semver.Version{
+		"90105":   semver.MustParse("9.1.5"),
+		"90624":   semver.MustParse("9.6.24"),
+		"100023":  semver.MustParse("10.23.0"),
+		"160001":  semver.MustParse("16.1.0"),
+		" 170000": semver.MustParse("17.0.0"),
+	}
+	for in, expected := range cases {
+		v, err := parseVersionNum(in)
+		c.Assert(err, IsNil, Commentf(in))
+		c.Check(v.EQ(expected), Equals, true, Commentf("%s: got %s", in, v))
+	}
+
+	for _, in := range []string{"", "abc", "9999"} {
+		_, err := parseVersionNum(in)
+		c.Check(err, NotNil, Commentf(in))
+	}
+}
+
+func (s *VersionSuite) TestParseServerVersion(c *C) {
+	cases := map[string]semver.Version{
+		"9.6.5":                semver.MustParse("9.6.5"),
+		"12.3 (Debian 12.3-1)": semver.MustParse("12.3.0"),
+		"16beta1":              semver.MustParse("16.0.0"),
+	}
+	for in, expected := range cases {
+		v, err := parseServerVersion(in)
+		c.Assert(err, IsNil, Commentf(in))
+		c.Check(v.EQ(expected), Equals, true, Commentf("%s: got %s", in, v))
+	}
+
+	_, err := parseServerVersion("devel")
+	c.Check(err, NotNil)
+}
+
+func (s *VersionSuite) TestParseFlavour(c *C) {
+	c.Check(parseFlavour("PostgreSQL 12.3 on x86_64-pc-linux-gnu"), Equals, flavourPostgreSQL)
+	c.Check(parseFlavour("EnterpriseDB 9.6.5.10 on x86_64-pc-linux-gnu"), Equals, flavourEPAS)
+	c.Check(parseFlavour("PostgreSQL 12.3 (EnterpriseDB Advanced Server 12.3.4) on x86_64-pc-linux-gnu"), Equals, flavourEPAS)
+}
+
+func (s *VersionSuite) TestNamespaceRequirements(c *C) {
+	caps := &capabilities{relations: map[string]bool{"pg_stat_io": true}}
+
+	c.Check(namespaceRequirements["pg_stat_io"].unmetBy(flavourPostgreSQL, caps), Equals, "")
+	c.Check(namespaceRequirements["pg_stat_wal"].unmetBy(flavourPostgreSQL, caps), Not(Equals), "")
+	c.Check(namespaceRequirements["pg_stat_wal"].unmetBy(flavourPostgreSQL, nil), Equals, "")
+	c.Check(namespaceRequirements["pg_edb_audit_settings"].unmetBy(flavourPostgreSQL, nil), Not(Equals), "")
+	c.Check(namespaceRequirements["pg_edb_audit_settings"].unmetBy(flavourEPAS, caps), Equals, "")
+}
+
+func (s *VersionSuite) TestExtensionRequirements(c *C) {
+	caps := &capabilities{extensions: map[string]string{
+		"pg_stat_statements": "1.8",
+		"timescaledb":        "2.11.0-dev",
+		"oddity":             "unstable",
+	}}
+
+	cases := map[string]bool{
+		"pg_stat_statements":            true,
+		"pg_stat_statements>=1.8":       true,
+		"pg_stat_statements >=1.4 <1.8": false,
+		"pg_stat_statements>=1.9":       false,
+		"timescaledb>=2":                true,
+		"pg_buffercache":                false,
+		"oddity":                        true,
+		"oddity>=1":                     false,
+	}
+	for in, expected := range cases {
+		r, err := parseExtensionRequirement(in)
+		c.Assert(err, IsNil, Commentf(in))
+		c.Check(caps.hasExtension(r), Equals, expected, Commentf(in))
+	}
+
+	for _, in := range []string{"", ">=1.0", "pg_stat_statements>=one"} {
+		_, err := parseExtensionRequirement(in)
+		c.Check(err, NotNil, Commentf(in))
+	}
+
+	requirement := namespaceRequirement{extension: mustParseExtensionRequirement("pg_buffercache")}
+	c.Check(requirement.unmetBy(flavourPostgreSQL, caps), Equals, "extension pg_buffercache is not installed")
+}
+
+func (s *VersionSuite) TestAddQueriesRequiresExtension(c *C) {
+	server := &Server{
+		metricMap:      map[string]MetricMapNamespace{"pg_stat_statements": {}},
+		queryOverrides: map[string]string{"pg_stat_statements": "SELECT 1"},
+		queryArgs:      map[string][]interface{}{},
+		capabilities:   &capabilities{extensions: map[string]string{"pgstattuple": "1.5"}},
+	}
+	content := []byte(`
+pg_stat_statements:
+  query: "SELECT queryid, calls FROM pg_stat_statements"
+  requires_extension: "pg_stat_statements>=1.4"
+  metrics:
+    - queryid:
+        usage: "LABEL"
+        description: "Query ID"
+    - calls:
+        usage: "COUNTER"
+        description: "Number of times executed"
+pgstattuple:
+  query: "SELECT dead_tuple_percent FROM pgstattuple('pg_class')"
+  requires_extension: "pgstattuple"
+  metrics:
+    - dead_tuple_percent:
+        usage: "GAUGE"
+        description: "Percentage of dead tuples"
+`)
+
+	c.Assert(addQueries(content, semver.MustParse("12.0.0"), server), IsNil)
+	_, found := server.metricMap["pg_stat_statements"]
+	c.Check(found, Equals, false)
+	_, found = server.queryOverrides["pg_stat_statements"]
+	c.Check(found, Equals, false)
+	_, found = server.metricMap["pgstattuple"]
+	c.Check(found, Equals, true)
+	_, found = server.queryOverrides["pgstattuple"]
+	c.Check(found, Equals, true)
+}
+
+func (s *VersionSuite) TestMetricCache(c *C) {
+	server := &Server{}
+	desc := prometheus.NewDesc("pg_buffercache_summary_buffers_used", "", nil, nil)
+	metric := prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 42)
+
+	ch := make(chan prometheus.Metric, 1)
+	c.Check(server.replayCachedMetrics(ch, "pg_buffercache_summary"), Equals, false)
+
+	server.cacheMetrics("pg_buffercache_summary", []prometheus.Metric{metric}, time.Minute)
+	c.Check(server.replayCachedMetrics(ch, "pg_buffercache_summary"), Equals, true)
+	c.Check(<-ch, Equals, metric)
+
+	server.cacheMetrics("pg_buffercache_summary", []prometheus.Metric{metric}, -time.Minute)
+	c.Check(server.replayCachedMetrics(ch, "pg_buffercache_summary"), Equals, false)
+
+	server.cacheMetrics("pg_buffercache_summary", []prometheus.Metric{metric}, time.Minute)
+	server.resetMetricCache()
+	c.Check(server.replayCachedMetrics(ch, "pg_buffercache_summary"), Equals, false)
+}
+
+func (s *VersionSuite) TestBufferCacheOptIn(c *C) {
+	e := NewExporter(nil)
+	c.Check(e.disabledNamespaces(), DeepEquals, bufferCacheNamespaces)
+
+	e = NewExporter(nil, CollectBufferCache(true), BufferCacheInterval(time.Hour))
+	c.Check(e.disabledNamespaces(), HasLen, 0)
+	c.Check(e.makeCacheIntervals()["pg_buffercache_relation"], Equals, time.Hour)
+}
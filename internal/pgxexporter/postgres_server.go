@@ -4,11 +4,19 @@ import (
 	"context"
 	"fmt"
 	"github.com/blang/semver"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
-	//	pgx "github.com/jackc/pgx/v4"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
+	"net"
 	"sync"
+	"time"
+)
+
+// Scrapes only need a few connections, and none in between.
+const (
+	defaultMinConns = 0
+	defaultMaxConns = 3
 )
 
 // ServerOpt configures a server.
@@ -17,19 +25,58 @@ type ServerOpt func(*Server)
 // Server describes a connection to Postgres.
 // Also it contains metrics map and query overrides.
 type Server struct {
-	//	db *pgx.Conn
-	db *pgxpool.Pool
+	// Connection pool, created on first use by acquire
+	db         *pgxpool.Pool
+	poolConfig *pgxpool.Config
+	poolMtx    sync.Mutex
+	// Held while creating the pool, which connects, and while changing the
+	// configuration it is created with, but not by those only reading db
+	createMtx sync.Mutex
+	// Settings applied to every connection of the pool
+	session SessionConfig
+	// TLS settings replacing those of the DSN, if any, and their files
+	tlsConfig *TLSConfig
+	tls       *tlsFiles
+	// Provider of the credentials overriding those of the DSN, if any, and
+	// the credentials last obtained from it
+	secrets           SecretProvider
+	credentials       Credentials
+	credentialReloads prometheus.Counter
+	// Circuit breaker of the DSN, if the server belongs to a collection
+	breaker *dsnBreaker
 
 	labels prometheus.Labels
 
 	// Last version used to calculate metric map. If mismatch on scrape,
 	// then maps are recalculated.
 	lastMapVersion semver.Version
+	// Flavour of postgres the metric map was calculated for.
+	lastMapFlavour string
+	// Capabilities probed when the metric map was calculated, nil if the
+	// probe failed.
+	capabilities *capabilities
 	// Currently active metric map
 	metricMap map[string]MetricMapNamespace
 	// Currently active query overrides
 	queryOverrides map[string]string
+	// Arguments bound to the placeholders of the active query overrides
+	queryArgs map[string][]interface{}
+	// How long the metrics of the active namespaces are cached, if at all
+	cacheIntervals map[string]time.Duration
 	mappingMtx     sync.RWMutex
+
+	// Which pg_settings are exported and how
+	settings settingsOptions
+
+	// Metrics of the namespaces with a cache interval, by namespace
+	metricCache map[string]cachedMetrics
+	cacheMtx    sync.Mutex
+}
+
+// cachedMetrics are the metrics of a namespace kept between scrapes.
+type cachedMetrics struct {
+	metrics []prometheus.Metric
+	expiry  time.Time
 }
 
 // ServerWithLabels configures a set of labels.
@@ -41,28 +88,125 @@ func ServerWithLabels(labels prometheus.Labels) ServerOpt {
 	}
 }
 
-// NewServer establishes a new connection using DSN.
+// settingsOptions configures the pg_settings metrics of a server.
+type settingsOptions struct {
+	// String and enum settings exported by pg_settings_info, none if empty
+	infoAllowlist []string
+	// Label pg_settings_pending_restart with the source of each setting
+	sourceLabels bool
+	// Counts the settings exported with a unit that could not be converted
+	unknownUnits prometheus.Counter
+	// Selects the settings exported at all, every one if nil
+	filter *nameFilter
+}
+
+// ServerWithSettingsInfo exports the string and enum settings named in the
+// allowlist as pg_settings_info.
+func ServerWithSettingsInfo(allowlist []string) ServerOpt {
+	return func(s *Server) {
+		s.settings.infoAllowlist = allowlist
+	}
+}
+
+// ServerWithSettingsSourceLabels labels pg_settings_pending_restart with the
+// source and source file of each setting.
+func ServerWithSettingsSourceLabels(b bool) ServerOpt {
+	return func(s *Server) {
+		s.settings.sourceLabels = b
+	}
+}
+
+// ServerWithSettingsUnknownUnits counts the settings exported with a unit that
+// could not be converted in c.
+func ServerWithSettingsUnknownUnits(c prometheus.Counter) ServerOpt {
+	return func(s *Server) {
+		s.settings.unknownUnits = c
+	}
+}
+
+// ServerWithSettingsFilter only exports the settings whose names match one of
+// the include patterns, if any, and none of the exclude patterns. Invalid
+// patterns are ignored, see Config.Validate.
+func ServerWithSettingsFilter(include, exclude []string) ServerOpt {
+	return func(s *Server) {
+		filter, err := newNameFilter(include, exclude)
+		if err != nil {
+			log.Errorf("Ignoring settings patterns: %v", err)
+			return
+		}
+		s.settings.filter = filter
+	}
+}
+
+// ServerWithPoolConfig overrides the pool settings which are set in c.
+func ServerWithPoolConfig(c PoolConfig) ServerOpt {
+	return func(s *Server) {
+		if c.MinConns != nil {
+			s.poolConfig.MinConns = *c.MinConns
+		}
+		if c.MaxConns != nil {
+			s.poolConfig.MaxConns = *c.MaxConns
+		}
+		if c.MaxConnLifetime != nil {
+			s.poolConfig.MaxConnLifetime = *c.MaxConnLifetime
+		}
+		if c.MaxConnIdleTime != nil {
+			s.poolConfig.MaxConnIdleTime = *c.MaxConnIdleTime
+		}
+		if c.HealthCheckPeriod != nil {
+			s.poolConfig.HealthCheckPeriod = *c.HealthCheckPeriod
+		}
+	}
+}
+
+// ServerWithSessionConfig overrides the session settings which are set in c.
+func ServerWithSessionConfig(c SessionConfig) ServerOpt {
+	return func(s *Server) {
+		s.session = s.session.merge(c)
+	}
+}
+
+// ServerWithTLSConfig makes the connections use TLS as configured in c,
+// whatever the sslmode of the DSN. Nothing changes if c is nil.
+func ServerWithTLSConfig(c *TLSConfig) ServerOpt {
+	return func(s *Server) {
+		if c != nil {
+			s.tlsConfig = c
+		}
+	}
+}
+
+// ServerWithSecretProvider obtains the user name and password from p instead
+// of the DSN, if p is not nil. The pool is rebuilt with the new credentials
+// when they change, which is counted in reloads.
+func ServerWithSecretProvider(p SecretProvider, reloads prometheus.Counter) ServerOpt {
+	return func(s *Server) {
+		if p != nil {
+			s.secrets = p
+			s.credentialReloads = reloads
+		}
+	}
+}
+
+// NewServer configures a new connection pool using DSN. No connection is
+// established until the server is first used.
 func NewServer(dsn string, opts ...ServerOpt) (*Server, error) {
 	fingerprint, err := parseFingerprint(dsn)
 	if err != nil {
 		return nil, err
 	}
-	log.Debug("Configuring database with DSN:", dsn)
+	log.Debug("Configuring database with DSN:", loggableDSN(dsn))
 	config, err := pgxpool.ParseConfig(dsn)
-	config.MinConns = 1
-	config.MaxConns = 3
-
-	log.Debugf("Database configuration to be used: %v", config)
-
-	conn, err := pgxpool.ConnectConfig(context.TODO(), config)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Error parsing DSN: %v", redactDSNError(dsn, err))
 	}
-
-	log.Infof("Established new database connection to %q.", fingerprint)
+	config.MinConns = defaultMinConns
+	config.MaxConns = defaultMaxConns
 
 	s := &Server{
-		db: conn,
+		poolConfig: config,
+		// The DSN's own runtime parameters win over the defaults.
+		session: defaultSessionConfig().without(dsnParameters(config.ConnConfig)),
 		labels: prometheus.Labels{
 			serverLabelName: fingerprint,
 		},
@@ -71,28 +215,207 @@ func NewServer(dsn string, opts ...ServerOpt) (*Server, error) {
 	for _, opt := range opts {
 		opt(s)
 	}
+	// pgconn does not watch the context while negotiating TLS, so a server
+	// accepting connections without answering would hang connecting. The
+	// deadline of the context is set on the connection until it is established.
+	dial := config.ConnConfig.DialFunc
+	config.ConnConfig.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			if err := conn.SetDeadline(deadline); err != nil {
+				conn.Close() // nolint: errcheck
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+	config.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		if err := conn.PgConn().Conn().SetDeadline(time.Time{}); err != nil {
+			return err
+		}
+		return s.session.afterConnect(ctx, conn)
+	}
+
+	if s.secrets != nil {
+		credentials, err := s.secrets.Credentials(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("Error obtaining credentials for %q: %v", fingerprint, err)
+		}
+		s.setCredentials(credentials)
+	}
+
+	if s.tlsConfig != nil {
+		if s.tls, err = newTLSFiles(*s.tlsConfig); err != nil {
+			return nil, fmt.Errorf("Error configuring TLS for %q: %v", fingerprint, err)
+		}
+		s.tls.apply(&config.ConnConfig.Config)
+	}
 
 	return s, nil
 }
 
+// Acquire a connection, creating the pool if this is its first use. If the
+// credentials come from a secret provider, the pool is rebuilt when they
+// change and they are obtained again if authentication fails. The outcome is
+// reported on the circuit breaker of the server, which fails fast while open.
+// Unless ctx has a deadline, acquire gives up after acquireTimeout.
+func (s *Server) acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, acquireTimeout)
+		defer cancel()
+	}
+	if s.breaker == nil {
+		return s.acquireWithCredentials(ctx)
+	}
+	if err := s.breaker.allow(); err != nil {
+		return nil, err
+	}
+	conn, err := s.acquireWithCredentials(ctx)
+	s.breaker.record(err)
+	return conn, err
+}
+
+func (s *Server) acquireWithCredentials(ctx context.Context) (*pgxpool.Conn, error) {
+	s.refreshCredentials(ctx)
+
+	conn, err := s.acquirePool(ctx)
+	if err != nil && isAuthError(err) && s.secrets != nil {
+		s.poolMtx.Lock()
+		rejected := s.credentials
+		s.poolMtx.Unlock()
+		s.secrets.Invalidate(rejected)
+		if s.refreshCredentials(ctx) {
+			log.Infof("Authentication failed on %q, retrying with the refreshed credentials", s)
+			conn, err = s.acquirePool(ctx)
+		}
+	}
+	return conn, err
+}
+
+func (s *Server) acquirePool(ctx context.Context) (*pgxpool.Conn, error) {
+	db, err := s.pool(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.Acquire(ctx)
+}
+
+// Return the pool, creating it if needed. Creating it connects, so poolMtx is
+// not held meanwhile and the pool statistics can still be collected.
+func (s *Server) pool(ctx context.Context) (*pgxpool.Pool, error) {
+	s.poolMtx.Lock()
+	db := s.db
+	s.poolMtx.Unlock()
+	if db != nil {
+		return db, nil
+	}
+
+	s.createMtx.Lock()
+	defer s.createMtx.Unlock()
+	s.poolMtx.Lock()
+	db = s.db
+	s.poolMtx.Unlock()
+	if db != nil {
+		return db, nil
+	}
+
+	log.Debugf("Creating connection pool for %q: min %d, max %d connections", s, s.poolConfig.MinConns, s.poolConfig.MaxConns)
+	db, err := pgxpool.ConnectConfig(ctx, s.poolConfig)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Established new database connection to %q.", s)
+	s.poolMtx.Lock()
+	s.db = db
+	s.poolMtx.Unlock()
+	return db, nil
+}
+
+// Override the credentials of the DSN, where given.
+func (s *Server) setCredentials(c Credentials) {
+	if c.User != "" {
+		s.poolConfig.ConnConfig.User = c.User
+	}
+	if c.Password != "" {
+		s.poolConfig.ConnConfig.Password = c.Password
+	}
+	s.credentials = c
+}
+
+// Obtain the credentials from the secret provider, and drop the pool if they
+// changed so that it is rebuilt with them. Reports whether the pool was
+// dropped.
+func (s *Server) refreshCredentials(ctx context.Context) bool {
+	if s.secrets == nil {
+		return false
+	}
+	credentials, err := s.secrets.Credentials(ctx)
+	if err != nil {
+		log.Errorf("Keeping the previous credentials of %q: %v", s, err)
+		return false
+	}
+
+	// The pool must not be created with the previous credentials meanwhile.
+	s.createMtx.Lock()
+	defer s.createMtx.Unlock()
+	s.poolMtx.Lock()
+	if credentials.equal(s.credentials) {
+		s.credentials = credentials
+		s.poolMtx.Unlock()
+		return false
+	}
+	s.setCredentials(credentials)
+	db := s.db
+	s.db = nil
+	s.poolMtx.Unlock()
+
+	if db != nil {
+		// Close waits for the acquired connections to be released.
+		go db.Close()
+	}
+	if s.credentialReloads != nil {
+		s.credentialReloads.Inc()
+	}
+	log.Infof("Reloaded the credentials of %q", s)
+	return true
+}
+
 // Close disconnects from Postgres.
 func (s *Server) Close() {
-	s.db.Close()
+	s.poolMtx.Lock()
+	defer s.poolMtx.Unlock()
+
+	if s.db != nil {
+		s.db.Close()
+		s.db = nil
+	}
 	log.Debug("database connection pool for this server:", s)
 }
 
+// How long Ping waits for a connection and its answer.
+const pingTimeout = 10 * time.Second
+
+// How long acquiring a connection may take at most, connecting if needed.
+const acquireTimeout = 10 * time.Second
+
 // Ping checks connection availability and possibly invalidates the connection if it fails.
 func (s *Server) Ping() error {
 	log.Debug("Pinging database server")
-	conn, err := s.db.Acquire(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+
+	conn, err := s.acquire(ctx)
 	if err != nil {
 		log.Errorf("unable to acquire db connect: %v", err)
 		return err
 	}
 	defer conn.Release()
 
-	conn.Conn().Ping(context.Background())
-	if err := conn.Conn().Ping(context.Background()); err != nil {
+	if err := conn.Conn().Ping(ctx); err != nil {
 		log.Errorf("Error while ping database to %q: %v", s, err)
 		return err
 	}
@@ -104,8 +427,9 @@ func (s *Server) String() string {
 	return s.labels[serverLabelName]
 }
 
-// Scrape loads metrics.
-func (s *Server) Scrape(ch chan<- prometheus.Metric, disableSettingsMetrics bool) error {
+// Scrape loads metrics. Namespaces restricted to other kinds of DSN than
+// those the server is scraped as are skipped.
+func (s *Server) Scrape(ch chan<- prometheus.Metric, disableSettingsMetrics bool, kinds dsnKind) error {
 	s.mappingMtx.RLock()
 	defer s.mappingMtx.RUnlock()
 
@@ -117,10 +441,94 @@ func (s *Server) Scrape(ch chan<- prometheus.Metric, disableSettingsMetrics bool
 		}
 	}
 
-	errMap := queryNamespaceMappings(ch, s)
+	errMap := queryNamespaceMappings(ch, s, kinds)
 	if len(errMap) > 0 {
 		err = fmt.Errorf("queryNamespaceMappings returned %d errors", len(errMap))
 	}
 
 	return err
 }
+
+// Send the cached metrics of the namespace to ch, unless there are none or
+// they have expired.
+func (s *Server) replayCachedMetrics(ch chan<- prometheus.Metric, namespace string) bool {
+	s.cacheMtx.Lock()
+	cached, ok := s.metricCache[namespace]
+	s.cacheMtx.Unlock()
+
+	if !ok || time.Now().After(cached.expiry) {
+		return false
+	}
+	for _, m := range cached.metrics {
+		ch <- m
+	}
+	return true
+}
+
+// Keep the metrics of the namespace for the interval.
+func (s *Server) cacheMetrics(namespace string, metrics []prometheus.Metric, interval time.Duration) {
+	s.cacheMtx.Lock()
+	defer s.cacheMtx.Unlock()
+
+	if s.metricCache == nil {
+		s.metricCache = make(map[string]cachedMetrics)
+	}
+	s.metricCache[namespace] = cachedMetrics{metrics: metrics, expiry: time.Now().Add(interval)}
+}
+
+// Drop all cached metrics, whose descriptors may no longer match the metric map.
+func (s *Server) resetMetricCache() {
+	s.cacheMtx.Lock()
+	defer s.cacheMtx.Unlock()
+
+	s.metricCache = nil
+}
+
+// Labels of the metrics about the server itself rather than its contents.
+// Servers of databases discovered on the same host share its server label.
+func (s *Server) selfLabels() prometheus.Labels {
+	labels := prometheus.Labels{"database": s.poolConfig.ConnConfig.Database}
+	for k, v := range s.labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// Send the expiry time of the TLS client certificate, if there is one.
+func (s *Server) collectTLSStats(ch chan<- prometheus.Metric) {
+	if s.tls != nil {
+		s.tls.collect(ch, s.selfLabels())
+	}
+}
+
+// Send the statistics of the connection pool, if it has been created.
+func (s *Server) collectPoolStats(ch chan<- prometheus.Metric) {
+	s.poolMtx.Lock()
+	db := s.db
+	s.poolMtx.Unlock()
+	if db == nil {
+		return
+	}
+
+	labels := s.selfLabels()
+
+	stat := db.Stat()
+	for _, m := range []struct {
+		name, help string
+		valueType  prometheus.ValueType
+		value      float64
+	}{
+		{"acquired_conns", "Number of connections currently acquired from the pool.", prometheus.GaugeValue, float64(stat.AcquiredConns())},
+		{"idle_conns", "Number of idle connections in the pool.", prometheus.GaugeValue, float64(stat.IdleConns())},
+		{"constructing_conns", "Number of connections being established.", prometheus.GaugeValue, float64(stat.ConstructingConns())},
+		{"total_conns", "Number of connections in the pool, acquired, idle or being established.", prometheus.GaugeValue, float64(stat.TotalConns())},
+		{"max_conns", "Maximum number of connections in the pool.", prometheus.GaugeValue, float64(stat.MaxConns())},
+		{"acquires_total", "Total number of connections acquired from the pool.", prometheus.CounterValue, float64(stat.AcquireCount())},
+		{"acquire_duration_seconds_total", "Total time spent acquiring connections from the pool, in seconds.", prometheus.CounterValue, stat.AcquireDuration().Seconds()},
+		{"empty_acquires_total", "Total number of acquires which had to wait for a connection, because the pool had none idle.", prometheus.CounterValue, float64(stat.EmptyAcquireCount())},
+		{"canceled_acquires_total", "Total number of acquires canceled before they got a connection.", prometheus.CounterValue, float64(stat.CanceledAcquireCount())},
+	} {
+		desc := prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "pool_"+m.name), m.help, nil, labels)
+		ch <- prometheus.MustNewConstMetric(desc, m.valueType, m.value)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"github.com/blang/semver"
-	"github.com/jackc/pgproto3/v2"
 	"github.com/jackc/pgx/v4"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
@@ -48,6 +47,84 @@ var queryOverrides = map[string][]OverrideQuery{
 		},
 	},
 
+	// PostgreSQL 17 moved the checkpoint columns of pg_stat_bgwriter to
+	// pg_stat_checkpointer and the backend writes to pg_stat_io. Map them back
+	// so the metric names stay the same across the split.
+	"pg_stat_bgwriter": {
+		{
+			semver.MustParseRange(">=17.0.0"),
+			`
+			SELECT
+				c.num_timed AS checkpoints_timed,
+				c.num_requested AS checkpoints_req,
+				c.restartpoints_timed,
+				c.restartpoints_req,
+				c.restartpoints_done,
+				c.write_time AS checkpoint_write_time,
+				c.sync_time AS checkpoint_sync_time,
+				c.buffers_written AS buffers_checkpoint,
+				b.buffers_clean,
+				b.maxwritten_clean,
+				io.buffers_backend,
+				io.buffers_backend_fsync,
+				b.buffers_alloc,
+				b.stats_reset
+			FROM pg_stat_bgwriter b
+			CROSS JOIN pg_stat_checkpointer c
+			CROSS JOIN (
+				SELECT
+					COALESCE(sum(writes), 0)::float AS buffers_backend,
+					COALESCE(sum(fsyncs), 0)::float AS buffers_backend_fsync
+				FROM pg_stat_io
+				WHERE object = 'relation'
+					AND backend_type NOT IN ('checkpointer', 'background writer')
+			) io
+			`,
+		},
+		{
+			semver.MustParseRange("<17.0.0"),
+			`SELECT * FROM pg_stat_bgwriter`,
+		},
+	},
+
+	"pg_stat_wal": {
+		{
+			semver.MustParseRange(">=18.0.0"),
+			`
+			SELECT
+				wal_records,
+				wal_fpi,
+				wal_bytes::float AS wal_bytes,
+				wal_buffers_full,
+				stats_reset
+			FROM pg_stat_wal
+			`,
+		},
+		{
+			semver.MustParseRange(">=14.0.0 <18.0.0"),
+			`
+			SELECT
+				wal_records,
+				wal_fpi,
+				wal_bytes::float AS wal_bytes,
+				wal_buffers_full,
+				wal_write,
+				wal_sync,
+				wal_write_time,
+				wal_sync_time,
+				stats_reset
+			FROM pg_stat_wal
+			`,
+		},
+	},
+
+	"pg_stat_io": {
+		{
+			semver.MustParseRange(">=16.0.0"),
+			`SELECT * FROM pg_stat_io`,
+		},
+	},
+
 	"pg_stat_replication": {
 		{
 			semver.MustParseRange(">=10.0.0"),
@@ -119,6 +196,492 @@ var queryOverrides = map[string][]OverrideQuery{
 			`,
 		},
 	},
+
+	// $1 is the idle in transaction threshold in seconds, see
+	// Exporter.makeQueryArgs.
+	"pg_stat_activity_detail": {
+		{
+			semver.MustParseRange(">=9.6.0"),
+			`
+			SELECT
+				datname,
+				COALESCE(usename, '') AS usename,
+				COALESCE(application_name, '') AS application_name,
+				COALESCE(wait_event_type, '') AS wait_event_type,
+				COALESCE(MAX(CASE WHEN state = 'active' THEN EXTRACT(EPOCH FROM now() - query_start) END), 0)::float AS max_query_duration,
+				COALESCE(MAX(CASE WHEN state <> 'idle' THEN EXTRACT(EPOCH FROM now() - state_change) END), 0)::float AS max_state_duration,
+				SUM(CASE WHEN state IN ('idle in transaction', 'idle in transaction (aborted)')
+					AND now() - state_change > $1::float8 * interval '1 second' THEN 1 ELSE 0 END) AS idle_in_transaction_over_threshold
+			FROM pg_stat_activity
+			WHERE datname IS NOT NULL AND pid <> pg_backend_pid()
+			GROUP BY 1, 2, 3, 4
+			`,
+		},
+		{
+			semver.MustParseRange(">=9.2.0 <9.6.0"),
+			`
+			SELECT
+				datname,
+				COALESCE(usename, '') AS usename,
+				COALESCE(application_name, '') AS application_name,
+				CASE WHEN waiting THEN 'Lock' ELSE '' END AS wait_event_type,
+				COALESCE(MAX(CASE WHEN state = 'active' THEN EXTRACT(EPOCH FROM now() - query_start) END), 0)::float AS max_query_duration,
+				COALESCE(MAX(CASE WHEN state <> 'idle' THEN EXTRACT(EPOCH FROM now() - state_change) END), 0)::float AS max_state_duration,
+				SUM(CASE WHEN state IN ('idle in transaction', 'idle in transaction (aborted)')
+					AND now() - state_change > $1::float8 * interval '1 second' THEN 1 ELSE 0 END) AS idle_in_transaction_over_threshold
+			FROM pg_stat_activity
+			WHERE datname IS NOT NULL AND pid <> pg_backend_pid()
+			GROUP BY 1, 2, 3, 4
+			`,
+		},
+	},
+
+	// The progress views are cluster wide, but relation OIDs can only be
+	// resolved to names from within the database they belong to.
+	"pg_stat_progress_vacuum": {
+		{
+			semver.MustParseRange(">=9.6.0"),
+			`
+			SELECT
+				p.*,
+				CASE WHEN p.datname = current_database() THEN p.relid::regclass::text ELSE p.relid::text END AS relname,
+				(CASE p.phase WHEN 'vacuuming heap' THEN p.heap_blks_vacuumed ELSE p.heap_blks_scanned END)::float
+					/ NULLIF(p.heap_blks_total, 0) AS progress_ratio
+			FROM pg_stat_progress_vacuum p
+			`,
+		},
+	},
+
+	"pg_stat_progress_create_index": {
+		{
+			semver.MustParseRange(">=12.0.0"),
+			`
+			SELECT
+				p.*,
+				CASE WHEN p.datname = current_database() THEN p.relid::regclass::text ELSE p.relid::text END AS relname,
+				COALESCE(p.blocks_done::float / NULLIF(p.blocks_total, 0),
+					p.tuples_done::float / NULLIF(p.tuples_total, 0)) AS progress_ratio
+			FROM pg_stat_progress_create_index p
+			`,
+		},
+	},
+
+	"pg_stat_progress_cluster": {
+		{
+			semver.MustParseRange(">=12.0.0"),
+			`
+			SELECT
+				p.*,
+				CASE WHEN p.datname = current_database() THEN p.relid::regclass::text ELSE p.relid::text END AS relname,
+				p.heap_blks_scanned::float / NULLIF(p.heap_blks_total, 0) AS progress_ratio
+			FROM pg_stat_progress_cluster p
+			`,
+		},
+	},
+
+	"pg_stat_progress_analyze": {
+		{
+			semver.MustParseRange(">=13.0.0"),
+			`
+			SELECT
+				p.*,
+				CASE WHEN p.datname = current_database() THEN p.relid::regclass::text ELSE p.relid::text END AS relname,
+				p.sample_blks_scanned::float / NULLIF(p.sample_blks_total, 0) AS progress_ratio
+			FROM pg_stat_progress_analyze p
+			`,
+		},
+	},
+
+	"pg_stat_progress_basebackup": {
+		{
+			semver.MustParseRange(">=13.0.0"),
+			`
+			SELECT
+				p.*,
+				p.backup_streamed::float / NULLIF(p.backup_total, 0) AS progress_ratio
+			FROM pg_stat_progress_basebackup p
+			`,
+		},
+	},
+
+	"pg_stat_progress_copy": {
+		{
+			semver.MustParseRange(">=14.0.0"),
+			`
+			SELECT
+				p.*,
+				CASE WHEN p.datname = current_database() THEN p.relid::regclass::text ELSE p.relid::text END AS relname,
+				p.bytes_processed::float / NULLIF(p.bytes_total, 0) AS progress_ratio
+			FROM pg_stat_progress_copy p
+			`,
+		},
+	},
+
+	// The relation namespaces report on the database the exporter is
+	// connected to, so cover every database with --auto-discover-databases.
+	// $1 is the minimum relation size in bytes and $2 the maximum number of
+	// relations returned (NULL for all), see Exporter.makeQueryArgs.
+	"pg_table_size": {
+		{
+			semver.MustParseRange(">=9.0.0"),
+			`
+			SELECT
+				current_database() AS datname,
+				n.nspname AS schemaname,
+				c.relname,
+				pg_relation_size(c.oid) AS table_bytes,
+				pg_indexes_size(c.oid) AS indexes_bytes,
+				COALESCE(pg_total_relation_size(NULLIF(c.reltoastrelid, 0)), 0) AS toast_bytes,
+				pg_total_relation_size(c.oid) AS total_bytes
+			FROM pg_class c
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE c.relkind IN ('r', 'm')
+				AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+				AND n.nspname !~ '^pg_toast'
+				AND pg_total_relation_size(c.oid) >= $1::bigint
+			ORDER BY total_bytes DESC
+			LIMIT $2::bigint
+			`,
+		},
+	},
+
+	// Estimate based on the column statistics, after
+	// https://github.com/ioguix/pgsql-bloat-estimation
+	"pg_table_bloat": {
+		{
+			semver.MustParseRange(">=9.0.0"),
+			`
+			SELECT
+				current_database() AS datname,
+				schemaname,
+				tblname AS relname,
+				(bs * tblpages)::bigint AS real_bytes,
+				(GREATEST(tblpages - est_tblpages_ff, 0) * bs)::bigint AS bloat_bytes,
+				CASE WHEN tblpages > 0 THEN GREATEST(tblpages - est_tblpages_ff, 0)::float / tblpages ELSE 0 END AS bloat_ratio
+			FROM (
+				SELECT
+					ceil(reltuples / ((bs - page_hdr) * fillfactor / (tpl_size * 100))) + ceil(toasttuples / 4) AS est_tblpages_ff,
+					tblpages, bs, schemaname, tblname, is_na
+				FROM (
+					SELECT
+						(4 + tpl_hdr_size + tpl_data_size + (2 * ma)
+							- CASE WHEN tpl_hdr_size % ma = 0 THEN ma ELSE tpl_hdr_size % ma END
+							- CASE WHEN ceil(tpl_data_size)::int % ma = 0 THEN ma ELSE ceil(tpl_data_size)::int % ma END
+						) AS tpl_size,
+						heappages + toastpages AS tblpages,
+						reltuples, toasttuples, bs, page_hdr, schemaname, tblname, fillfactor, is_na
+					FROM (
+						SELECT
+							ns.nspname AS schemaname,
+							tbl.relname AS tblname,
+							tbl.reltuples,
+							tbl.relpages AS heappages,
+							COALESCE(toast.relpages, 0) AS toastpages,
+							COALESCE(toast.reltuples, 0) AS toasttuples,
+							COALESCE(substring(array_to_string(tbl.reloptions, ' ') FROM 'fillfactor=([0-9]+)')::smallint, 100) AS fillfactor,
+							current_setting('block_size')::numeric AS bs,
+							CASE WHEN version() ~ 'mingw32|64-bit|x86_64|ppc64|ia64|amd64' THEN 8 ELSE 4 END AS ma,
+							24 AS page_hdr,
+							23 + CASE WHEN MAX(COALESCE(s.null_frac, 0)) > 0 THEN (7 + count(s.attname)) / 8 ELSE 0::int END
+								+ CASE WHEN bool_or(att.attname = 'oid' AND att.attnum < 0) THEN 4 ELSE 0 END AS tpl_hdr_size,
+							sum((1 - COALESCE(s.null_frac, 0)) * COALESCE(s.avg_width, 0)) AS tpl_data_size,
+							bool_or(att.atttypid = 'pg_catalog.name'::regtype)
+								OR sum(CASE WHEN att.attnum > 0 THEN 1 ELSE 0 END) <> count(s.attname) AS is_na
+						FROM pg_attribute att
+						JOIN pg_class tbl ON att.attrelid = tbl.oid
+						JOIN pg_namespace ns ON ns.oid = tbl.relnamespace
+						LEFT JOIN pg_stats s ON s.schemaname = ns.nspname
+							AND s.tablename = tbl.relname AND s.inherited = false AND s.attname = att.attname
+						LEFT JOIN pg_class toast ON tbl.reltoastrelid = toast.oid
+						WHERE NOT att.attisdropped
+							AND tbl.relkind IN ('r', 'm')
+							AND ns.nspname NOT IN ('pg_catalog', 'information_schema')
+						GROUP BY 1, 2, 3, 4, 5, 6, 7, 8, 9, 10
+					) AS s
+				) AS s2
+			) AS s3
+			WHERE NOT is_na
+				AND bs * tblpages >= $1::bigint
+			ORDER BY bloat_bytes DESC
+			LIMIT $2::bigint
+			`,
+		},
+	},
+
+	// Unique indexes are left out as they enforce a constraint whether they
+	// are scanned or not.
+	"pg_index_unused": {
+		{
+			semver.MustParseRange(">=9.0.0"),
+			`
+			SELECT
+				current_database() AS datname,
+				s.schemaname,
+				s.relname,
+				s.indexrelname,
+				pg_relation_size(s.indexrelid) AS size_bytes
+			FROM pg_stat_user_indexes s
+			JOIN pg_index i ON i.indexrelid = s.indexrelid
+			WHERE s.idx_scan = 0
+				AND NOT i.indisunique
+				AND pg_relation_size(s.indexrelid) >= $1::bigint
+			ORDER BY size_bytes DESC
+			LIMIT $2::bigint
+			`,
+		},
+	},
+
+	// Scanning pg_buffercache briefly locks every buffer partition, so these
+	// are only queried every --buffercache-interval. The view covers the whole
+	// cluster, so apart from pg_buffercache_relation they are only queried on
+	// the configured DSN and not again for each discovered database.
+	"pg_buffercache_summary": {
+		{
+			semver.MustParseRange(">=9.1.0"),
+			`
+			SELECT
+				sum(CASE WHEN relfilenode IS NOT NULL THEN 1 ELSE 0 END)::bigint AS buffers_used,
+				sum(CASE WHEN relfilenode IS NULL THEN 1 ELSE 0 END)::bigint AS buffers_unused,
+				sum(CASE WHEN isdirty THEN 1 ELSE 0 END)::bigint AS buffers_dirty
+			FROM pg_buffercache
+			`,
+		},
+	},
+	"pg_buffercache_database": {
+		{
+			semver.MustParseRange(">=9.1.0"),
+			`
+			SELECT
+				CASE WHEN b.reldatabase = 0 THEN 'global' ELSE COALESCE(d.datname, b.reldatabase::text) END AS datname,
+				count(*) AS buffers,
+				sum(CASE WHEN b.isdirty THEN 1 ELSE 0 END)::bigint AS dirty_buffers
+			FROM pg_buffercache b
+			LEFT JOIN pg_database d ON d.oid = b.reldatabase
+			WHERE b.reldatabase IS NOT NULL
+			GROUP BY 1
+			`,
+		},
+	},
+	"pg_buffercache_usage_count": {
+		{
+			semver.MustParseRange(">=9.1.0"),
+			`
+			SELECT
+				CASE WHEN b.reldatabase = 0 THEN 'global' ELSE COALESCE(d.datname, b.reldatabase::text) END AS datname,
+				b.usagecount::text AS usagecount,
+				count(*) AS buffers
+			FROM pg_buffercache b
+			LEFT JOIN pg_database d ON d.oid = b.reldatabase
+			WHERE b.reldatabase IS NOT NULL
+			GROUP BY 1, 2
+			`,
+		},
+	},
+	// Buffers can only be attributed to relations of the database the exporter
+	// is connected to, and to shared catalogs.
+	"pg_buffercache_relation": {
+		{
+			semver.MustParseRange(">=9.1.0"),
+			`
+			SELECT
+				current_database() AS datname,
+				n.nspname AS schemaname,
+				c.relname,
+				count(*) AS buffers,
+				sum(CASE WHEN b.isdirty THEN 1 ELSE 0 END)::bigint AS dirty_buffers,
+				avg(b.usagecount)::float AS usage_count_avg
+			FROM pg_buffercache b
+			JOIN pg_class c ON b.relfilenode = pg_relation_filenode(c.oid)
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE b.reldatabase IN (0, (SELECT oid FROM pg_database WHERE datname = current_database()))
+			GROUP BY n.nspname, c.relname
+			ORDER BY buffers DESC
+			LIMIT $1::bigint
+			`,
+		},
+	},
+
+	// Sequences belong to the database the exporter is connected to, so this
+	// is only queried on the databases found by --auto-discover-databases,
+	// which cover the database of the target without reporting it twice.
+	"pg_sequence_usage": {
+		{
+			semver.MustParseRange(">=10.0.0"),
+			`
+			SELECT
+				current_database() AS datname,
+				schemaname,
+				sequencename,
+				last_value,
+				CASE WHEN increment_by > 0 THEN max_value ELSE min_value END AS max_value,
+				(CASE WHEN increment_by > 0 THEN last_value::numeric - min_value ELSE max_value::numeric - last_value END
+					/ NULLIF(max_value::numeric - min_value, 0))::float AS used_ratio
+			FROM pg_sequences
+			`,
+		},
+		{
+			// Before pg_sequences each sequence has to be read on its own, which
+			// query_to_xml lets us do without a function in the database.
+			semver.MustParseRange(">=9.1.0 <10.0.0"),
+			`
+			SELECT
+				current_database() AS datname,
+				schemaname,
+				sequencename,
+				last_value,
+				CASE WHEN increment_by > 0 THEN max_value ELSE min_value END AS max_value,
+				(CASE WHEN increment_by > 0 THEN last_value::numeric - min_value ELSE max_value::numeric - last_value END
+					/ NULLIF(max_value::numeric - min_value, 0))::float AS used_ratio
+			FROM (
+				SELECT
+					schemaname,
+					sequencename,
+					(xpath('/row/last_value/text()', x))[1]::text::bigint AS last_value,
+					(xpath('/row/max_value/text()', x))[1]::text::bigint AS max_value,
+					(xpath('/row/min_value/text()', x))[1]::text::bigint AS min_value,
+					(xpath('/row/increment_by/text()', x))[1]::text::bigint AS increment_by
+				FROM (
+					SELECT
+						n.nspname AS schemaname,
+						c.relname AS sequencename,
+						query_to_xml(format('SELECT last_value, max_value, min_value, increment_by FROM %I.%I', n.nspname, c.relname), false, true, '') AS x
+					FROM pg_class c
+					JOIN pg_namespace n ON n.oid = c.relnamespace
+					WHERE c.relkind = 'S'
+						AND has_sequence_privilege(c.oid, 'SELECT')
+				) AS seqs
+			) AS s
+			`,
+		},
+	},
+
+	// Parallel apply workers (PostgreSQL 16+) report on behalf of their
+	// leader, so only the leader is exported.
+	"pg_stat_subscription": {
+		{
+			semver.MustParseRange(">=16.0.0"),
+			`
+			SELECT
+				su.subname,
+				CASE WHEN s.relid IS NULL THEN 'apply' ELSE 'table synchronization' END AS worker_type,
+				CASE WHEN s.relid IS NULL THEN ''
+					WHEN su.subdbid = (SELECT oid FROM pg_database WHERE datname = current_database()) THEN s.relid::regclass::text
+					ELSE s.relid::text END AS relname,
+				CASE WHEN s.pid IS NULL THEN 0 ELSE 1 END AS active,
+				pg_wal_lsn_diff(s.received_lsn, '0/0')::float AS received_lsn,
+				pg_wal_lsn_diff(s.latest_end_lsn, '0/0')::float AS latest_end_lsn,
+				pg_wal_lsn_diff(s.received_lsn, s.latest_end_lsn)::float AS apply_lag_bytes,
+				EXTRACT(EPOCH FROM now() - s.latest_end_time)::float AS apply_lag_seconds,
+				EXTRACT(EPOCH FROM now() - s.last_msg_receipt_time)::float AS last_msg_receipt_age_seconds
+			FROM pg_stat_subscription s
+			JOIN pg_subscription su ON su.oid = s.subid
+			WHERE s.leader_pid IS NULL
+			`,
+		},
+		{
+			semver.MustParseRange(">=10.0.0 <16.0.0"),
+			`
+			SELECT
+				su.subname,
+				CASE WHEN s.relid IS NULL THEN 'apply' ELSE 'table synchronization' END AS worker_type,
+				CASE WHEN s.relid IS NULL THEN ''
+					WHEN su.subdbid = (SELECT oid FROM pg_database WHERE datname = current_database()) THEN s.relid::regclass::text
+					ELSE s.relid::text END AS relname,
+				CASE WHEN s.pid IS NULL THEN 0 ELSE 1 END AS active,
+				pg_wal_lsn_diff(s.received_lsn, '0/0')::float AS received_lsn,
+				pg_wal_lsn_diff(s.latest_end_lsn, '0/0')::float AS latest_end_lsn,
+				pg_wal_lsn_diff(s.received_lsn, s.latest_end_lsn)::float AS apply_lag_bytes,
+				EXTRACT(EPOCH FROM now() - s.latest_end_time)::float AS apply_lag_seconds,
+				EXTRACT(EPOCH FROM now() - s.last_msg_receipt_time)::float AS last_msg_receipt_age_seconds
+			FROM pg_stat_subscription s
+			JOIN pg_subscription su ON su.oid = s.subid
+			`,
+		},
+	},
+
+	"pg_subscription_rel": {
+		{
+			semver.MustParseRange(">=10.0.0"),
+			`
+			SELECT
+				su.subname,
+				sr.srrelid::regclass::text AS relname,
+				sr.srsubstate::text AS state
+			FROM pg_subscription_rel sr
+			JOIN pg_subscription su ON su.oid = sr.srsubid
+			`,
+		},
+	},
+
+	"pg_stat_subscription_stats": {
+		{
+			semver.MustParseRange(">=15.0.0"),
+			`SELECT * FROM pg_stat_subscription_stats`,
+		},
+	},
+
+	"pg_publication": {
+		{
+			semver.MustParseRange(">=10.0.0"),
+			`
+			SELECT
+				current_database() AS datname,
+				p.pubname,
+				p.puballtables AS all_tables,
+				(SELECT count(*) FROM pg_publication_tables pt WHERE pt.pubname = p.pubname) AS tables
+			FROM pg_publication p
+			`,
+		},
+	},
+
+	"pg_replication_slots_logical": {
+		{
+			semver.MustParseRange(">=10.0.0"),
+			`
+			SELECT
+				slot_name,
+				database AS datname,
+				plugin,
+				active,
+				pg_wal_lsn_diff(
+					CASE pg_is_in_recovery() WHEN 't' THEN pg_last_wal_receive_lsn() ELSE pg_current_wal_lsn() END,
+					confirmed_flush_lsn)::float AS confirmed_flush_lag_bytes
+			FROM pg_replication_slots
+			WHERE slot_type = 'logical'
+			`,
+		},
+	},
+
+	// EDB Postgres Advanced Server only, see namespaceRequirements.
+	// The DRITA wait statistics are only as fresh as the latest edbsnap().
+	"pg_edb_system_waits": {
+		{
+			semver.MustParseRange(">=9.0.0"),
+			`
+			SELECT
+				w.dbname AS datname,
+				w.wait_name,
+				w.wait_count,
+				w.totalwait::float AS total_wait_time
+			FROM sys.edb$system_waits w
+			WHERE w.edb_id = (SELECT max(edb_id) FROM sys.edb$snap)
+			`,
+		},
+	},
+
+	"pg_edb_audit_settings": {
+		{
+			semver.MustParseRange(">=9.0.0"),
+			`
+			SELECT
+				name,
+				setting,
+				1 AS info
+			FROM pg_settings
+			WHERE name LIKE 'edb\_audit%'
+			`,
+		},
+	},
 }
 
 // Convert the query override file to the version-specific query override file
@@ -165,6 +728,7 @@ func addQueries(content []byte, pgVersion semver.Version, server *Server) error
 	// Stores the loaded map representation
 	metricMaps := make(map[string]map[string]ColumnMapping)
 	newQueryOverrides := make(map[string]string)
+	requirements := make(map[string]namespaceRequirement)
 
 	for metric, specs := range extra {
 		log.Debugln("New user metric namespace from YAML:", metric)
@@ -174,6 +738,13 @@ func addQueries(content []byte, pgVersion semver.Version, server *Server) error
 				query := value.(string)
 				newQueryOverrides[metric] = query
 
+			case "requires_extension":
+				extension, err := parseExtensionRequirement(value.(string))
+				if err != nil {
+					return fmt.Errorf("Error parsing %s: %v", metric, err)
+				}
+				requirements[metric] = namespaceRequirement{extension: extension}
+
 			case "metrics":
 				for _, c := range value.([]interface{}) {
 					column := c.(map[interface{}]interface{})
@@ -217,6 +788,18 @@ func addQueries(content []byte, pgVersion semver.Version, server *Server) error
 		}
 	}
 
+	// Disable the namespaces the server cannot answer, including any builtin
+	// namespace of the same name.
+	for metric, requirement := range requirements {
+		if reason := requirement.unmetBy(server.lastMapFlavour, server.capabilities); reason != "" {
+			log.Debugln(metric, "from user YAML file is being disabled as", reason)
+			delete(metricMaps, metric)
+			delete(newQueryOverrides, metric)
+			delete(server.metricMap, metric)
+			delete(server.queryOverrides, metric)
+		}
+	}
+
 	// Convert the loaded metric map into exporter representation
 	partialExporterMap := makeDescMap(pgVersion, server.labels, metricMaps)
 
@@ -240,6 +823,9 @@ func addQueries(content []byte, pgVersion semver.Version, server *Server) error
 			log.Debugln("Adding new query override", k, "from user YAML file.")
 		}
 		server.queryOverrides[k] = v
+		// User queries take no arguments and are not cached
+		delete(server.queryArgs, k)
+		delete(server.cacheIntervals, k)
 	}
 
 	return nil
@@ -247,14 +833,14 @@ func addQueries(content []byte, pgVersion semver.Version, server *Server) error
 
 func queryDatabases(server *Server) ([]string, error) {
 	ctx := context.Background()
-	conn, err := server.db.Acquire(context.Background())
+	conn, err := server.acquire(context.Background())
 	if err != nil {
 		log.Errorf("unable to acquire db connect: %v", err)
 		return nil, err
 	}
 	defer conn.Release()
 
-	rows, err := conn.Conn().Query(ctx, "SELECT datname FROM pg_database WHERE datallowconn = true AND datistemplate = false") // nolint: safesql
+	rows, err := conn.Conn().Query(ctx, "SELECT datname FROM pg_database WHERE datallowconn = true AND datistemplate = false ORDER BY datname") // nolint: safesql
 	if err != nil {
 		log.Debugln("error connecting for query to get databases", err)
 		return nil, fmt.Errorf("Error retrieving databases: %v", err)
@@ -279,7 +865,7 @@ func queryDatabases(server *Server) ([]string, error) {
 // the scrape fails, and a slice of errors if they were non-fatal.
 func queryNamespaceMapping(ch chan<- prometheus.Metric, server *Server, namespace string, mapping MetricMapNamespace) ([]error, error) {
 	ctx := context.Background()
-	conn, err := server.db.Acquire(context.Background())
+	conn, err := server.acquire(context.Background())
 	if err != nil {
 		log.Errorf("unable to acquire db connect: %v", err)
 		return nil, err
@@ -299,50 +885,42 @@ func queryNamespaceMapping(ch chan<- prometheus.Metric, server *Server, namespac
 	// Don't fail on a bad scrape of one metric
 	var rows pgx.Rows
 
-	var fields []pgproto3.FieldDescription
-
 	if !found {
 		query = fmt.Sprintf("SELECT * FROM %s;", namespace)
 	}
-	var rowCount = 0
-	rows, err = conn.Conn().Query(ctx, query) // nolint: safesql
+	rows, err = conn.Conn().Query(ctx, query, server.queryArgs[namespace]...) // nolint: safesql
 	if err != nil {
 		return []error{}, fmt.Errorf("Error running query on database %q: %s %v", server, namespace, err)
 	}
 	defer rows.Close() // nolint: errcheck
-	for rows.Next() {
-		if rowCount == 0 {
-			fields = rows.FieldDescriptions()
-			break
-		}
-		rowCount++
-	}
 
-	//defer rows.Close() // nolint: errcheck
+	return scanNamespaceRows(ch, server, namespace, mapping, rows)
+}
 
+// Turn the rows returned for a namespace into metrics. Returns a slice of
+// errors for columns that could not be converted, and an error if the rows
+// could not be read.
+func scanNamespaceRows(ch chan<- prometheus.Metric, server *Server, namespace string, mapping MetricMapNamespace, rows pgx.Rows) ([]error, error) {
 	var columnNames []string
 
-	for _, v := range fields {
-		columnNames = append(columnNames, string(v.Name))
-
-	}
-
 	// Make a lookup map for the column indices
-	var columnIdx = make(map[string]int, len(columnNames))
-	for i, n := range columnNames {
-		columnIdx[n] = i
-	}
-
-	var columnData = make([]interface{}, len(columnNames))
-	var scanArgs = make([]interface{}, len(columnNames))
-	for i := range columnData {
-		scanArgs[i] = &columnData[i]
-	}
+	var columnIdx map[string]int
 
 	nonfatalErrors := []error{}
 	for rows.Next() {
-		columnData, err = rows.Values()
-		//		err = rows.Scan(scanArgs...)
+		// The field descriptions are only known once the first row has been
+		// read, so build the column lookup here rather than consuming a row
+		// up front.
+		if columnIdx == nil {
+			fields := rows.FieldDescriptions()
+			columnIdx = make(map[string]int, len(fields))
+			for i, v := range fields {
+				columnNames = append(columnNames, string(v.Name))
+				columnIdx[string(v.Name)] = i
+			}
+		}
+
+		columnData, err := rows.Values()
 		if err != nil {
 			log.Debugln("error retrieving row", err)
 			return []error{}, errors.New(fmt.Sprintln("Error retrieving rows:", namespace, err))
@@ -364,7 +942,7 @@ func queryNamespaceMapping(ch chan<- prometheus.Metric, server *Server, namespac
 					continue
 				}
 
-				value, ok := DBToFloat64(columnData[idx])
+				value, ok := metricMapping.conversion(columnData[idx])
 				if !ok {
 					nonfatalErrors = append(nonfatalErrors, errors.New(fmt.Sprintln("Unexpected error parsing column: ", namespace, columnName, columnData[idx])))
 					continue
@@ -389,18 +967,31 @@ func queryNamespaceMapping(ch chan<- prometheus.Metric, server *Server, namespac
 			}
 		}
 	}
+	if err := rows.Err(); err != nil {
+		return nonfatalErrors, fmt.Errorf("Error running query on database %q: %s %v", server, namespace, err)
+	}
 	return nonfatalErrors, nil
 }
 
 // Iterate through all the namespace mappings in the exporter and run their
 // queries.
-func queryNamespaceMappings(ch chan<- prometheus.Metric, server *Server) map[string]error {
+func queryNamespaceMappings(ch chan<- prometheus.Metric, server *Server, kinds dsnKind) map[string]error {
 	// Return a map of namespace -> errors
 	namespaceErrors := make(map[string]error)
 
 	for namespace, mapping := range server.metricMap {
+		if !namespaceRequirements[namespace].queriedOn(kinds) {
+			log.Debugln("Skipping namespace on this DSN: ", namespace)
+			continue
+		}
+
+		if server.replayCachedMetrics(ch, namespace) {
+			log.Debugln("Using cached metrics for namespace: ", namespace)
+			continue
+		}
+
 		log.Debugln("Querying namespace: ", namespace)
-		nonFatalErrors, err := queryNamespaceMapping(ch, server, namespace, mapping)
+		nonFatalErrors, err := queryCachedNamespaceMapping(ch, server, namespace, mapping)
 		// Serious error - a namespace disappeared
 		if err != nil {
 			namespaceErrors[namespace] = err
@@ -416,3 +1007,33 @@ func queryNamespaceMappings(ch chan<- prometheus.Metric, server *Server) map[str
 
 	return namespaceErrors
 }
+
+// Query a namespace and, if it has a cache interval, keep its metrics for the
+// following scrapes. Failed queries are not cached.
+func queryCachedNamespaceMapping(ch chan<- prometheus.Metric, server *Server, namespace string, mapping MetricMapNamespace) ([]error, error) {
+	interval := server.cacheIntervals[namespace]
+	if interval <= 0 {
+		return queryNamespaceMapping(ch, server, namespace, mapping)
+	}
+
+	metricCh := make(chan prometheus.Metric)
+	doneCh := make(chan struct{})
+	var metrics []prometheus.Metric
+
+	go func() {
+		for m := range metricCh {
+			metrics = append(metrics, m)
+			ch <- m
+		}
+		close(doneCh)
+	}()
+
+	nonFatalErrors, err := queryNamespaceMapping(metricCh, server, namespace, mapping)
+	close(metricCh)
+	<-doneCh
+
+	if err == nil {
+		server.cacheMetrics(namespace, metrics, interval)
+	}
+	return nonFatalErrors, err
+}
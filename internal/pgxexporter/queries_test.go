@@ -0,0 +1,105 @@
+// +build !integration
+
+package pgxexporter
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type QueriesSuite struct{}
+
+var _ = Suite(&QueriesSuite{})
+
+// fakeRows replays a fixed result set. Only the methods used when scanning a
+// namespace are implemented.
+type fakeRows struct {
+	pgx.Rows
+	fields []pgproto3.FieldDescription
+	values [][]interface{}
+	err    error
+	row    int
+}
+
+func newFakeRows(columns []string, values ...[]interface{}) *fakeRows {
+	r := &fakeRows{values: values, row: -1}
+	for _, column := range columns {
+		r.fields = append(r.fields, pgproto3.FieldDescription{Name: []byte(column)})
+	}
+	return r
+}
+
+func (r *fakeRows) Next() bool {
+	r.row++
+	return r.row < len(r.values)
+}
+
+func (r *fakeRows) FieldDescriptions() []pgproto3.FieldDescription { return r.fields }
+
+func (r *fakeRows) Values() ([]interface{}, error) { return r.values[r.row], nil }
+
+func (r *fakeRows) Err() error { return r.err }
+
+func (r *fakeRows) Close() {}
+
+func scanFakeRows(rows pgx.Rows, mapping MetricMapNamespace) ([]*dto.Metric, []error, error) {
+	ch := make(chan prometheus.Metric, 100)
+	nonFatalErrors, err := scanNamespaceRows(ch, &Server{}, "pg_test", mapping, rows)
+	close(ch)
+
+	var metrics []*dto.Metric
+	for m := range ch {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err != nil {
+			panic(err)
+		}
+		metrics = append(metrics, pb)
+	}
+	return metrics, nonFatalErrors, err
+}
+
+func (s *QueriesSuite) TestScanNamespaceRowsKeepsFirstRow(c *C) {
+	mapping := makeDescMap(semver.MustParse("12.0.0"), prometheus.Labels{}, map[string]map[string]ColumnMapping{
+		"pg_test": {
+			"datname": {LABEL, "Name of the database", nil, nil},
+			"value":   {GAUGE, "A value", nil, nil},
+		},
+	})["pg_test"]
+
+	rows := newFakeRows([]string{"datname", "value"},
+		[]interface{}{"first", int64(1)},
+		[]interface{}{"second", int64(2)},
+	)
+	metrics, nonFatalErrors, err := scanFakeRows(rows, mapping)
+	c.Assert(err, IsNil)
+	c.Check(nonFatalErrors, HasLen, 0)
+	c.Assert(metrics, HasLen, 2)
+	c.Check(metrics[0].GetLabel()[0].GetValue(), Equals, "first")
+	c.Check(metrics[0].GetGauge().GetValue(), Equals, float64(1))
+	c.Check(metrics[1].GetLabel()[0].GetValue(), Equals, "second")
+	c.Check(metrics[1].GetGauge().GetValue(), Equals, float64(2))
+}
+
+func (s *QueriesSuite) TestScanNamespaceRowsReportsRowsError(c *C) {
+	mapping := makeDescMap(semver.MustParse("12.0.0"), prometheus.Labels{}, map[string]map[string]ColumnMapping{
+		"pg_test": {
+			"value": {GAUGE, "A value", nil, nil},
+		},
+	})["pg_test"]
+
+	rows := newFakeRows([]string{"value"}, []interface{}{int64(1)})
+	rows.err = errors.New("canceling statement due to statement timeout")
+	metrics, _, err := scanFakeRows(rows, mapping)
+	c.Check(metrics, HasLen, 1)
+	c.Check(err, ErrorMatches, ".*statement timeout")
+}
@@ -1,8 +1,12 @@
 package pgxexporter
 
 import (
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
+	"math/rand"
 	"sync"
+	"time"
 )
 
 // Servers contains a collection of servers to Postgres.
@@ -10,36 +14,200 @@ type Servers struct {
 	m       sync.Mutex
 	servers map[string]*Server
 	opts    []ServerOpt
+	// Locks of the DSNs, held while creating their server so that only
+	// callers of the same DSN wait for it
+	locks map[string]*sync.Mutex
+
+	// Circuit breakers of the DSNs, whose metrics carry the constant labels
+	breakers map[string]*breaker
+	backoff  backoff
+	labels   prometheus.Labels
+	rnd      *rand.Rand
+	now      func() time.Time
 }
 
 // NewServers creates a collection of servers to Postgres.
 func NewServers(opts ...ServerOpt) *Servers {
 	return &Servers{
-		servers: make(map[string]*Server),
-		opts:    opts,
+		servers:  make(map[string]*Server),
+		opts:     opts,
+		locks:    make(map[string]*sync.Mutex),
+		breakers: make(map[string]*breaker),
+		backoff:  defaultBackoff(),
+		labels:   prometheus.Labels{},
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:      time.Now,
 	}
 }
 
-// GetServer returns established connection from a collection.
-func (s *Servers) GetServer(dsn string) (*Server, error) {
+// GetServer returns a server from the collection, creating it if needed. The
+// options are applied after those of the collection when the server is
+// created. The server only connects on its first use, which reports the
+// outcome on the circuit breaker of the DSN: after repeated failures to
+// connect, it fails fast until its backoff interval has passed.
+func (s *Servers) GetServer(dsn string, opts ...ServerOpt) (*Server, error) {
+	s.m.Lock()
+	b, ok := s.breakers[dsn]
+	if !ok {
+		b = &breaker{labels: s.dsnLabels(dsn)}
+		s.breakers[dsn] = b
+	}
+	if err := b.allow(s.now()); err != nil {
+		s.m.Unlock()
+		return nil, err
+	}
+	if server, ok := s.servers[dsn]; ok {
+		s.m.Unlock()
+		return server, nil
+	}
+	lock, ok := s.locks[dsn]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.locks[dsn] = lock
+	}
+	s.m.Unlock()
+
+	// Creating the server may obtain credentials, which takes a while.
+	lock.Lock()
+	defer lock.Unlock()
 	s.m.Lock()
-	defer s.m.Unlock()
-	var err error
 	server, ok := s.servers[dsn]
+	s.m.Unlock()
+	if ok {
+		return server, nil
+	}
+
+	server, err := NewServer(dsn, append(append([]ServerOpt{}, s.opts...), opts...)...)
+	if err != nil {
+		log.Error("Unable to create new server: ", err)
+		s.m.Lock()
+		s.failure(dsn, b, err)
+		s.m.Unlock()
+		return nil, err
+	}
+	server.breaker = &dsnBreaker{servers: s, dsn: dsn}
+	log.Debug("Created server", server)
+	s.m.Lock()
+	s.servers[dsn] = server
+	s.m.Unlock()
+	return server, nil
+}
+
+// Record a failure to connect to a DSN on its breaker. Requires s.m.
+func (s *Servers) failure(dsn string, b *breaker, err error) {
+	b.failure(s.now(), err, s.backoff, s.rnd)
+	if b.state(s.now()) == breakerOpen {
+		log.Warnf("Circuit breaker open for %s after %d connection failures, retrying at %s", loggableDSN(dsn), b.failures, b.nextRetry.Format(time.RFC3339))
+	}
+}
+
+// dsnBreaker is the circuit breaker of a DSN as its server sees it: the
+// server checks it before connecting and reports whether it could.
+type dsnBreaker struct {
+	servers *Servers
+	dsn     string
+}
+
+// Return an error if the breaker of the DSN is open.
+func (d *dsnBreaker) allow() error {
+	d.servers.m.Lock()
+	defer d.servers.m.Unlock()
+	return d.servers.breakers[d.dsn].allow(d.servers.now())
+}
+
+// Record the outcome of acquiring a connection to the DSN.
+func (d *dsnBreaker) record(err error) {
+	s := d.servers
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	b := s.breakers[d.dsn]
+	if err != nil {
+		s.failure(d.dsn, b, err)
+		return
+	}
+	if b.failures > 0 {
+		log.Infof("Connected to %s again after %d failures", loggableDSN(d.dsn), b.failures)
+	}
+	b.success()
+}
+
+// Return why a DSN is not ready, from the outcome of the last attempt to
+// connect to it and its circuit breaker, or nil if it is. Nothing connects.
+func (s *Servers) readiness(dsn string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	b, ok := s.breakers[dsn]
 	if !ok {
-		server, err = NewServer(dsn, s.opts...)
-		if err != nil {
-			log.Error("Unable to create new server: ", err)
-			return nil, err
+		return errNotConnected
+	}
+	return b.ready(s.now())
+}
+
+// Labels of the self metrics of a DSN, as those of its server, which may not
+// have been created.
+func (s *Servers) dsnLabels(dsn string) prometheus.Labels {
+	labels := prometheus.Labels{serverLabelName: loggableDSN(dsn), "database": ""}
+	for k, v := range s.labels {
+		labels[k] = v
+	}
+	if fingerprint, err := parseFingerprint(dsn); err == nil {
+		labels[serverLabelName] = fingerprint
+		if config, err := pgx.ParseConfig(dsn); err == nil {
+			labels["database"] = config.Database
 		}
-		log.Debug("Got a valid database connection for server", server)
-		s.servers[dsn] = server
 	}
-	if err = server.Ping(); err != nil {
+	return labels
+}
+
+// Send the connection pool and TLS statistics of all known servers, and the
+// state of the circuit breakers of all DSNs. They are collected from copies
+// taken under s.m, so that collecting does not hold it.
+func (s *Servers) collectStats(ch chan<- prometheus.Metric) {
+	s.m.Lock()
+	servers := make([]*Server, 0, len(s.servers))
+	for _, server := range s.servers {
+		servers = append(servers, server)
+	}
+	breakers := make([]breaker, 0, len(s.breakers))
+	for _, b := range s.breakers {
+		breakers = append(breakers, *b)
+	}
+	now := s.now()
+	s.m.Unlock()
+
+	for _, server := range servers {
+		server.collectPoolStats(ch)
+		server.collectTLSStats(ch)
+	}
+	for _, b := range breakers {
+		b.collect(ch, now)
+	}
+}
+
+// Forget the servers, circuit breakers and locks of the DSNs not kept, such as
+// those of databases which were dropped, closing their pools.
+func (s *Servers) prune(keep func(dsn string) bool) {
+	s.m.Lock()
+	var closing []*Server
+	for dsn := range s.breakers {
+		if keep(dsn) {
+			continue
+		}
+		if server, ok := s.servers[dsn]; ok {
+			closing = append(closing, server)
+		}
+		log.Debugf("Forgetting %s, which is no longer scraped", loggableDSN(dsn))
 		delete(s.servers, dsn)
-		return nil, err
+		delete(s.breakers, dsn)
+		delete(s.locks, dsn)
+	}
+	s.m.Unlock()
+
+	for _, server := range closing {
+		server.Close()
 	}
-	return server, nil
 }
 
 // Close disconnects from all known servers.
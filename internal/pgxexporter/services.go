@@ -0,0 +1,71 @@
+package pgxexporter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// Return the service a connection string refers to and the service file it is
+// defined in, the same way pgx looks them up. The service is empty if none.
+func connStringService(dsn string) (service, servicefile string) {
+	settings := parseConnStringSettings(dsn)
+
+	service = settings["service"]
+	if service == "" {
+		service = os.Getenv("PGSERVICE")
+	}
+	servicefile = settings["servicefile"]
+	if servicefile == "" {
+		servicefile = os.Getenv("PGSERVICEFILE")
+	}
+	if servicefile == "" {
+		if u, err := user.Current(); err == nil {
+			servicefile = filepath.Join(u.HomeDir, ".pg_service.conf")
+		}
+	}
+	return service, servicefile
+}
+
+// Check that the service a connection string refers to, if any, is defined in
+// a well-formed service file. pgx panics on missing services and malformed
+// files instead of returning an error.
+func checkService(dsn string) error {
+	service, servicefile := connStringService(dsn)
+	if service == "" {
+		return nil
+	}
+
+	f, err := os.Open(servicefile)
+	if err != nil {
+		return fmt.Errorf("Error reading service file for service %q: %v", service, err)
+	}
+	defer f.Close() // nolint: errcheck
+
+	found := false
+	inSection := false
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			inSection = true
+			if line[1:len(line)-1] == service {
+				found = true
+			}
+		case !inSection || !strings.Contains(line, "="):
+			return fmt.Errorf("Error parsing service file %q: unexpected line %d", servicefile, lineNum)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Error reading service file %q: %v", servicefile, err)
+	}
+	if !found {
+		return fmt.Errorf("Service %q not found in service file %q", service, servicefile)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// +build !integration
+
+package pgxexporter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type ServicesSuite struct{}
+
+var _ = Suite(&ServicesSuite{})
+
+const testServiceFile = `# Monitored servers
+[primary]
+host=db1.example.com
+port=5433
+dbname=postgres
+
+[replica]
+host=db2.example.com
+`
+
+func (s *ServicesSuite) TestCheckService(c *C) {
+	path := filepath.Join(c.MkDir(), "pg_service.conf")
+	c.Assert(ioutil.WriteFile(path, []byte(testServiceFile), 0600), IsNil)
+	defer os.Unsetenv("PGSERVICEFILE") // nolint: errcheck
+	c.Assert(os.Setenv("PGSERVICEFILE", path), IsNil)
+
+	c.Check(checkService("service=primary"), IsNil)
+	c.Check(checkService("postgresql:///?service=replica"), IsNil)
+	c.Check(checkService("postgresql://localhost:5432/postgres"), IsNil)
+	c.Check(checkService("service=missing"), ErrorMatches, `Service "missing" not found .*`)
+
+	fingerprint, err := parseFingerprint("service=primary")
+	c.Assert(err, IsNil)
+	c.Check(fingerprint, Equals, "db1.example.com:5433")
+	_, err = parseFingerprint("service=missing")
+	c.Check(err, NotNil)
+
+	// The service file of the DSN wins over the environment.
+	c.Check(checkService("service=primary servicefile='"+path+".missing'"), ErrorMatches, "Error reading service file .*")
+
+	c.Assert(ioutil.WriteFile(path, []byte("host=db1.example.com\n[primary]\n"), 0600), IsNil)
+	c.Check(checkService("service=primary"), ErrorMatches, "Error parsing service file .*: unexpected line 1")
+}
+
+func (s *ServicesSuite) TestDataSourceService(c *C) {
+	defer os.Unsetenv("DATA_SOURCE_SERVICE") // nolint: errcheck
+	c.Assert(os.Setenv("DATA_SOURCE_SERVICE", "primary, replica"), IsNil)
+
+	c.Check(getDataSources(""), DeepEquals, []string{"service=primary", "service=replica"})
+	userFile, passFile := GetCredentialFiles()
+	c.Check(userFile, Equals, "")
+	c.Check(passFile, Equals, "")
+}
+
+func (s *ServicesSuite) TestTargetService(c *C) {
+	path := filepath.Join(c.MkDir(), "config.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte("targets:\n  - service: primary\n"), 0600), IsNil)
+	config, err := LoadConfig(path)
+	c.Assert(err, IsNil)
+	c.Check(config.Targets[0].ConnString(), Equals, "service=primary")
+
+	c.Assert(ioutil.WriteFile(path, []byte("targets:\n  - service: primary\n    dsn: postgresql://localhost\n"), 0600), IsNil)
+	_, err = LoadConfig(path)
+	c.Check(err, ErrorMatches, ".*Target 0 needs either a dsn or a service.*")
+}
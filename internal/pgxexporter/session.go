@@ -0,0 +1,133 @@
+package pgxexporter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Session settings of the exporter's connections unless configured otherwise.
+func defaultSessionConfig() SessionConfig {
+	applicationName := "pgx_exporter"
+	statementTimeout := 30 * time.Second
+	lockTimeout := 5 * time.Second
+	idleInTransactionSessionTimeout := time.Minute
+	readOnly := true
+
+	return SessionConfig{
+		ApplicationName:                 &applicationName,
+		StatementTimeout:                &statementTimeout,
+		LockTimeout:                     &lockTimeout,
+		IdleInTransactionSessionTimeout: &idleInTransactionSessionTimeout,
+		ReadOnly:                        &readOnly,
+	}
+}
+
+// Return the session settings without those whose runtime parameter is in
+// params.
+func (c SessionConfig) without(params map[string]bool) SessionConfig {
+	if params["application_name"] {
+		c.ApplicationName = nil
+	}
+	if params["statement_timeout"] {
+		c.StatementTimeout = nil
+	}
+	if params["lock_timeout"] {
+		c.LockTimeout = nil
+	}
+	if params["idle_in_transaction_session_timeout"] {
+		c.IdleInTransactionSessionTimeout = nil
+	}
+	if params["default_transaction_read_only"] {
+		c.ReadOnly = nil
+	}
+	return c
+}
+
+// The runtime parameters a DSN sets, either directly or as command-line
+// options such as options='-c statement_timeout=10s'.
+func dsnParameters(config *pgx.ConnConfig) map[string]bool {
+	params := make(map[string]bool)
+	for name := range config.RuntimeParams {
+		params[name] = true
+	}
+
+	options := strings.Fields(config.RuntimeParams["options"])
+	for i := 0; i < len(options); i++ {
+		var option string
+		switch {
+		case options[i] == "-c" && i+1 < len(options):
+			i++
+			option = options[i]
+		case strings.HasPrefix(options[i], "--"):
+			option = options[i][2:]
+		case strings.HasPrefix(options[i], "-c"):
+			option = options[i][2:]
+		default:
+			continue
+		}
+		if name := strings.SplitN(option, "=", 2)[0]; name != "" {
+			// The server reads dashes in option names as underscores.
+			params[strings.Replace(name, "-", "_", -1)] = true
+		}
+	}
+	return params
+}
+
+// The runtime parameters to set for the session settings which are set.
+func (c SessionConfig) parameters() map[string]string {
+	params := make(map[string]string)
+	if c.ApplicationName != nil {
+		params["application_name"] = *c.ApplicationName
+	}
+	if c.StatementTimeout != nil {
+		params["statement_timeout"] = formatMilliseconds(*c.StatementTimeout)
+	}
+	if c.LockTimeout != nil {
+		params["lock_timeout"] = formatMilliseconds(*c.LockTimeout)
+	}
+	if c.IdleInTransactionSessionTimeout != nil {
+		params["idle_in_transaction_session_timeout"] = formatMilliseconds(*c.IdleInTransactionSessionTimeout)
+	}
+	if c.ReadOnly != nil {
+		params["default_transaction_read_only"] = "off"
+		if *c.ReadOnly {
+			params["default_transaction_read_only"] = "on"
+		}
+	}
+	return params
+}
+
+func formatMilliseconds(d time.Duration) string {
+	return fmt.Sprintf("%dms", d.Milliseconds())
+}
+
+// Apply the session settings to a new connection. Settings the server does not
+// know, such as idle_in_transaction_session_timeout before PostgreSQL 9.6, are
+// skipped rather than failing the connection.
+func (c SessionConfig) afterConnect(ctx context.Context, conn *pgx.Conn) error {
+	params := c.parameters()
+	if len(params) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(params))
+	values := make([]string, 0, len(params))
+	for name, value := range params {
+		names = append(names, name)
+		values = append(values, value)
+	}
+
+	// A multi-argument unnest would need PostgreSQL 9.4.
+	_, err := conn.Exec(ctx, `
+		SELECT set_config(s.name, ($2::text[])[i], false)
+		FROM generate_subscripts($1::text[], 1) AS i
+		JOIN pg_settings s ON s.name = ($1::text[])[i]`, names, values)
+	if err != nil {
+		return fmt.Errorf("Error applying session settings: %v", err)
+	}
+	return nil
+}
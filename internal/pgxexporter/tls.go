@@ -0,0 +1,190 @@
+package pgxexporter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// tlsFiles holds the CA and client certificates of a target, reloading them
+// whenever one of their files changes so rotated certificates are picked up
+// by the next connection.
+type tlsFiles struct {
+	config TLSConfig
+
+	mtx      sync.Mutex
+	modTimes map[string]time.Time
+	roots    *x509.CertPool   // nil to verify against the system roots
+	cert     *tls.Certificate // nil if no client certificate is configured
+	leaf     *x509.Certificate
+}
+
+func newTLSFiles(config TLSConfig) (*tlsFiles, error) {
+	f := &tlsFiles{config: config}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload the files if any of them has been modified since they were read.
+func (f *tlsFiles) reload() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	modTimes := make(map[string]time.Time)
+	changed := f.modTimes == nil
+	for _, path := range []string{f.config.CAFile, f.config.CertFile, f.config.KeyFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("Error reading TLS file: %v", err)
+		}
+		modTimes[path] = info.ModTime()
+		if !info.ModTime().Equal(f.modTimes[path]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	var roots *x509.CertPool
+	if f.config.CAFile != "" {
+		pem, err := ioutil.ReadFile(f.config.CAFile)
+		if err != nil {
+			return fmt.Errorf("Error reading CA file: %v", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("Error reading CA file %q: no certificates found", f.config.CAFile)
+		}
+	}
+
+	var cert *tls.Certificate
+	var leaf *x509.Certificate
+	if f.config.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(f.config.CertFile, f.config.KeyFile)
+		if err != nil {
+			return fmt.Errorf("Error reading client certificate: %v", err)
+		}
+		if leaf, err = x509.ParseCertificate(c.Certificate[0]); err != nil {
+			return fmt.Errorf("Error parsing client certificate: %v", err)
+		}
+		cert = &c
+	}
+
+	if f.modTimes != nil {
+		log.Infof("Reloaded TLS files: ca_file %q, cert_file %q", f.config.CAFile, f.config.CertFile)
+	}
+	f.modTimes, f.roots, f.cert, f.leaf = modTimes, roots, cert, leaf
+	return nil
+}
+
+// Return the current files, reloading them if they changed. A failed reload
+// keeps the files read before, as connections may still succeed with them.
+func (f *tlsFiles) current() (*x509.CertPool, *tls.Certificate, *x509.Certificate) {
+	if err := f.reload(); err != nil {
+		log.Errorf("Keeping the previous TLS files: %v", err)
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.roots, f.cert, f.leaf
+}
+
+// Build the TLS configuration of connections to host. The server certificate
+// is verified by hand, as the CA may change between connections.
+func (f *tlsFiles) tlsConfig(host string) *tls.Config {
+	serverName := f.config.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+
+	return &tls.Config{
+		ServerName: serverName,
+		// Verified in VerifyPeerCertificate against the current CA instead.
+		InsecureSkipVerify: true, // nolint: gosec
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			_, cert, _ := f.current()
+			if cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return cert, nil
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if f.config.InsecureSkipVerify {
+				return nil
+			}
+			if len(rawCerts) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			roots, _, _ := f.current()
+
+			opts := x509.VerifyOptions{
+				Roots:         roots,
+				DNSName:       serverName,
+				Intermediates: x509.NewCertPool(),
+			}
+			var leaf *x509.Certificate
+			for i, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return fmt.Errorf("Error parsing server certificate: %v", err)
+				}
+				if i == 0 {
+					leaf = cert
+				} else {
+					opts.Intermediates.AddCert(cert)
+				}
+			}
+			_, err := leaf.Verify(opts)
+			return err
+		},
+	}
+}
+
+// Make every connection of the pool use TLS with the configured files,
+// whatever the sslmode of the DSN. Plaintext fallbacks are dropped, except
+// over Unix domain sockets, which do not support TLS.
+func (f *tlsFiles) apply(config *pgconn.Config) {
+	if !isSocketHost(config.Host) {
+		config.TLSConfig = f.tlsConfig(config.Host)
+	}
+
+	fallbacks := config.Fallbacks[:0]
+	for _, fallback := range config.Fallbacks {
+		if isSocketHost(fallback.Host) {
+			fallbacks = append(fallbacks, fallback)
+			continue
+		}
+		if fallback.TLSConfig == nil {
+			continue
+		}
+		fallback.TLSConfig = f.tlsConfig(fallback.Host)
+		fallbacks = append(fallbacks, fallback)
+	}
+	config.Fallbacks = fallbacks
+}
+
+// Send the expiry time of the client certificate, if there is one.
+func (f *tlsFiles) collect(ch chan<- prometheus.Metric, labels prometheus.Labels) {
+	_, _, leaf := f.current()
+	if leaf == nil {
+		return
+	}
+
+	desc := prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "tls_cert_expiry_seconds"),
+		"Time at which the client certificate expires, in seconds since the epoch.", []string{"cert_file"}, labels)
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(leaf.NotAfter.Unix()), f.config.CertFile)
+}
@@ -0,0 +1,166 @@
+// +build !integration
+
+package pgxexporter
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	. "gopkg.in/check.v1"
+)
+
+type TLSSuite struct{}
+
+var _ = Suite(&TLSSuite{})
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// Issue a certificate, self-signed if parent is nil.
+func issueTestCert(c *C, name string, notAfter time.Time, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	c.Assert(err, IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	return &testCert{cert: cert, key: key}
+}
+
+func (t *testCert) write(c *C, certFile, keyFile string) {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: t.cert.Raw})
+	c.Assert(ioutil.WriteFile(certFile, certPEM, 0600), IsNil)
+	if keyFile != "" {
+		der, err := x509.MarshalECPrivateKey(t.key)
+		c.Assert(err, IsNil)
+		keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		c.Assert(ioutil.WriteFile(keyFile, keyPEM, 0600), IsNil)
+	}
+}
+
+// Handshake with a server presenting cert, returning the client's error.
+func handshake(config *tls.Config, cert *testCert) error {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		s := tls.Server(server, &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{cert.cert.Raw}, PrivateKey: cert.key}},
+			ClientAuth:   tls.RequestClientCert,
+		})
+		s.Handshake() // nolint: errcheck
+		s.Close()
+	}()
+
+	return tls.Client(client, config).Handshake()
+}
+
+func (s *TLSSuite) TestVerifyAndReload(c *C) {
+	dir := c.MkDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+
+	ca := issueTestCert(c, "ca", time.Now().Add(time.Hour), nil)
+	ca.write(c, caFile, "")
+	serverCert := issueTestCert(c, "db.example.com", time.Now().Add(time.Hour), ca)
+	clientExpiry := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	issueTestCert(c, "exporter", clientExpiry, ca).write(c, certFile, keyFile)
+
+	files, err := newTLSFiles(TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile})
+	c.Assert(err, IsNil)
+
+	c.Check(handshake(files.tlsConfig("db.example.com"), serverCert), IsNil)
+	c.Check(handshake(files.tlsConfig("other.example.com"), serverCert), NotNil)
+
+	// A server certificate of another CA is only accepted after the CA file
+	// has been rotated.
+	otherCA := issueTestCert(c, "other-ca", time.Now().Add(time.Hour), nil)
+	otherServerCert := issueTestCert(c, "db.example.com", time.Now().Add(time.Hour), otherCA)
+	config := files.tlsConfig("db.example.com")
+	c.Check(handshake(config, otherServerCert), NotNil)
+
+	otherCA.write(c, caFile, "")
+	later := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(caFile, later, later), IsNil)
+	c.Check(handshake(config, otherServerCert), IsNil)
+
+	insecure, err := newTLSFiles(TLSConfig{InsecureSkipVerify: true})
+	c.Assert(err, IsNil)
+	c.Check(handshake(insecure.tlsConfig("whatever"), otherServerCert), IsNil)
+
+	ch := make(chan prometheus.Metric, 1)
+	files.collect(ch, prometheus.Labels{"server": "db.example.com:5432"})
+	d := &dto.Metric{}
+	(<-ch).Write(d) // nolint: errcheck
+	c.Check(d.GetGauge().GetValue(), Equals, float64(clientExpiry.Unix()))
+}
+
+func (s *TLSSuite) TestValidate(c *C) {
+	dir := c.MkDir()
+	c.Check((&TLSConfig{CertFile: "client.pem"}).validate(), ErrorMatches, "cert_file and key_file must be given together")
+	c.Check((&TLSConfig{CAFile: filepath.Join(dir, "missing.pem")}).validate(), NotNil)
+
+	empty := filepath.Join(dir, "empty.pem")
+	c.Assert(ioutil.WriteFile(empty, nil, 0600), IsNil)
+	c.Check((&TLSConfig{CAFile: empty}).validate(), ErrorMatches, ".*no certificates found")
+
+	var unset *TLSConfig
+	c.Check(unset.validate(), IsNil)
+}
+
+func (s *TLSSuite) TestServerWithTLSConfig(c *C) {
+	server, err := NewServer("postgresql://db.example.com:5432/postgres?sslmode=prefer",
+		ServerWithTLSConfig(&TLSConfig{InsecureSkipVerify: true}))
+	c.Assert(err, IsNil)
+
+	conn := server.poolConfig.ConnConfig
+	c.Assert(conn.TLSConfig, NotNil)
+	c.Check(conn.TLSConfig.ServerName, Equals, "db.example.com")
+	for _, fallback := range conn.Fallbacks {
+		c.Check(fallback.TLSConfig, NotNil)
+	}
+
+	server, err = NewServer("postgresql://db.example.com:5432/postgres?sslmode=disable", ServerWithTLSConfig(nil))
+	c.Assert(err, IsNil)
+	c.Check(server.poolConfig.ConnConfig.TLSConfig, IsNil)
+
+	// Unix domain sockets do not support TLS.
+	server, err = NewServer("host=/var/run/postgresql", ServerWithTLSConfig(&TLSConfig{InsecureSkipVerify: true}))
+	c.Assert(err, IsNil)
+	c.Check(server.poolConfig.ConnConfig.TLSConfig, IsNil)
+}
@@ -5,10 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
-	"io/ioutil"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"math"
@@ -146,17 +144,23 @@ func DBToString(t interface{}) (string, bool) {
 }
 
 func parseFingerprint(url string) (string, error) {
+	if err := checkService(url); err != nil {
+		return "", err
+	}
 	configConn, err := pgx.ParseConfig(url)
 
 	if err != nil {
-		log.Errorf("Unable to parse URI %s.", url)
-		return "", err
+		log.Errorf("Unable to parse URI %s.", loggableDSN(url))
+		return "", redactDSNError(url, err)
 	}
 
 	var fingerprint string
 
 	if configConn.Host == "" {
 		fingerprint += "localhost"
+	} else if isSocketHost(configConn.Host) {
+		// Distinguish the socket directory from a relative host name.
+		fingerprint += "socket:" + configConn.Host
 	} else {
 		fingerprint += configConn.Host
 	}
@@ -176,7 +180,14 @@ func parseFingerprint(url string) (string, error) {
 	return fingerprint, nil
 }
 
+// Password of a key/value connection string, quoted or not.
+var connStringPasswordRegex = regexp.MustCompile(`\b(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S*)`)
+
 func loggableDSN(dsn string) string {
+	if !isURLDSN(dsn) {
+		return connStringPasswordRegex.ReplaceAllString(dsn, "${1}PASSWORD_REMOVED")
+	}
+
 	pDSN, err := url.Parse(dsn)
 	if err != nil {
 		return "could not parse DATA_SOURCE_NAME"
@@ -185,10 +196,20 @@ func loggableDSN(dsn string) string {
 	if pDSN.User != nil {
 		pDSN.User = url.UserPassword(pDSN.User.Username(), "PASSWORD_REMOVED")
 	}
+	// The password may also be given as a parameter.
+	if query := pDSN.Query(); query.Get("password") != "" {
+		query.Set("password", "PASSWORD_REMOVED")
+		pDSN.RawQuery = query.Encode()
+	}
 
 	return pDSN.String()
 }
 
+// Remove the DSN quoted by pgx parse errors, as it includes the password.
+func redactDSNError(dsn string, err error) error {
+	return errors.New(strings.Replace(err.Error(), dsn, loggableDSN(dsn), -1))
+}
+
 func parseConstLabels(s string) prometheus.Labels {
 	labels := make(prometheus.Labels)
 
@@ -222,56 +243,58 @@ type ErrorConnectToServer struct {
 
 // try to get the DataSource
 // DATA_SOURCE_NAME always wins so we do not break older versions
+// then the services of the service file named in DATA_SOURCE_SERVICE
 // reading secrets from files wins over secrets in environment variables
-// DATA_SOURCE_NAME > DATA_SOURCE_{USER|PASS}_FILE > DATA_SOURCE_{USER|PASS}
-func getDataSources(buildURI bool) []string {
-	var dsn = os.Getenv("DATA_SOURCE_NAME")
-	if len(dsn) == 0 {
-		var user string
-		var pass string
-
-		if len(os.Getenv("DATA_SOURCE_USER_FILE")) != 0 {
-			fileContents, err := ioutil.ReadFile(os.Getenv("DATA_SOURCE_USER_FILE"))
-			if err != nil {
-				panic(err)
+// DATA_SOURCE_NAME > DATA_SOURCE_SERVICE > DATA_SOURCE_{USER|PASS}_FILE > DATA_SOURCE_{USER|PASS}
+// In sidecar mode the data sources connect to sidecarHost instead, if it is
+// not empty.
+func getDataSources(sidecarHost string) []string {
+	var dsns []string
+	if dsn := os.Getenv("DATA_SOURCE_NAME"); len(dsn) != 0 {
+		dsns = strings.Split(dsn, ",")
+	} else if len(os.Getenv("DATA_SOURCE_SERVICE")) != 0 {
+		// Passwords are looked up in the password file, as with libpq.
+		for _, service := range strings.Split(os.Getenv("DATA_SOURCE_SERVICE"), ",") {
+			if service = strings.TrimSpace(service); service != "" {
+				dsns = append(dsns, "service="+service)
 			}
-			user = strings.TrimSpace(string(fileContents))
-		} else {
-			user = os.Getenv("DATA_SOURCE_USER")
 		}
+	} else {
+		var user = os.Getenv("DATA_SOURCE_USER")
+		var pass = os.Getenv("DATA_SOURCE_PASS")
 
-		if len(os.Getenv("DATA_SOURCE_PASS_FILE")) != 0 {
-			fileContents, err := ioutil.ReadFile(os.Getenv("DATA_SOURCE_PASS_FILE"))
-			if err != nil {
-				panic(err)
-			}
-			pass = strings.TrimSpace(string(fileContents))
-		} else {
-			pass = os.Getenv("DATA_SOURCE_PASS")
+		// The credential files are read by the same provider the servers
+		// refresh them with.
+		files := newFileSecretProvider(os.Getenv("DATA_SOURCE_USER_FILE"), os.Getenv("DATA_SOURCE_PASS_FILE"))
+		credentials, err := files.Credentials(context.Background())
+		if err != nil {
+			panic(err)
+		}
+		if files.userFile != "" {
+			user = credentials.User
+		}
+		if files.passFile != "" {
+			pass = credentials.Password
 		}
 
 		ui := url.UserPassword(user, pass).String()
 		uri := os.Getenv("DATA_SOURCE_URI")
-		dsn = "postgresql://" + ui + "@" + uri
+		dsns = []string{"postgresql://" + ui + "@" + uri}
+	}
 
-		config, err := pgxpool.ParseConfig(dsn)
+	if sidecarHost == "" {
+		return dsns
+	}
+	for i, dsn := range dsns {
+		sidecarDSN, err := dsnWithHost(dsn, sidecarHost)
 		if err != nil {
-			log.Error("Invalid DSN provided in URI", dsn)
-		}
-		if buildURI == true {
-			log.Debugln("changing the hostname to the env variable.")
-			config.ConnConfig.Host = os.Getenv("HOSTNAME")
-			dsn = fmt.Sprintf("postgresql://%s:%s@%s:%d/%s",
-				config.ConnConfig.User,
-				config.ConnConfig.Password,
-				config.ConnConfig.Host,
-				config.ConnConfig.Port,
-				config.ConnConfig.Database)
+			log.Errorf("Unable to replace the host of %s in sidecar mode: %v", loggableDSN(dsn), redactDSNError(dsn, err))
+			continue
 		}
-
-		return []string{dsn}
+		log.Debugf("Sidecar mode: connecting to %s", loggableDSN(sidecarDSN))
+		dsns[i] = sidecarDSN
 	}
-	return strings.Split(dsn, ",")
+	return dsns
 }
 
 func contains(a []string, x string) bool {
@@ -290,8 +313,20 @@ func contains(a []string, x string) bool {
 *
  */
 
-func GetDataSources(buildURI bool) []string {
-	return getDataSources(buildURI)
+// GetDataSources returns the DSNs of the environment, connecting to
+// sidecarHost instead of their host if it is not empty.
+func GetDataSources(sidecarHost string) []string {
+	return getDataSources(sidecarHost)
+}
+
+// GetCredentialFiles returns the DATA_SOURCE_USER_FILE and DATA_SOURCE_PASS_FILE
+// the data sources take their credentials from, which are ignored if
+// DATA_SOURCE_NAME or DATA_SOURCE_SERVICE is set.
+func GetCredentialFiles() (userFile, passFile string) {
+	if len(os.Getenv("DATA_SOURCE_NAME")) != 0 || len(os.Getenv("DATA_SOURCE_SERVICE")) != 0 {
+		return "", ""
+	}
+	return os.Getenv("DATA_SOURCE_USER_FILE"), os.Getenv("DATA_SOURCE_PASS_FILE")
 }
 
 // Error returns error
@@ -323,9 +358,12 @@ func WaitForDatabaseReadiness(dsn string) error {
 	// Ping checks connection availability and possibly invalidates the connection if it fails.
 	log.Debug("Pinging database server")
 
+	if err := checkService(dsn); err != nil {
+		return err
+	}
 	connConfig, err := pgx.ParseConfig(dsn)
 	if err != nil {
-		return err
+		return redactDSNError(dsn, err)
 	}
 
 	for i := 0; i <= 60; i++ {